@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// objectCache is an in-memory LRU cache of small objects. Entries expire
+// after a short TTL so that updates in the bucket show up eventually.
+// Expired entries are still returned, marked stale, for a further stale
+// period while the caller refreshes them.
+type objectCache struct {
+	mu         sync.Mutex
+	maxBytes   int64
+	ttl        time.Duration
+	stale      time.Duration
+	size       int64
+	ll         *list.List
+	items      map[string]*list.Element
+	refreshing map[string]bool
+}
+
+type cacheEntry struct {
+	key     string
+	obj     s3.GetObjectOutput
+	body    []byte
+	expires time.Time
+}
+
+func newObjectCache(maxBytes int64, ttl, stale time.Duration) *objectCache {
+	return &objectCache{
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		stale:      stale,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+		refreshing: map[string]bool{},
+	}
+}
+
+// get returns a copy of the cached object with a fresh body reader,
+// and whether it is stale.
+func (oc *objectCache) get(key string) (*s3.GetObjectOutput, bool, bool) {
+	entry, found, stale := oc.lookup(key)
+	if !found {
+		return nil, false, false
+	}
+	obj := entry.obj
+	obj.Body = ioutil.NopCloser(bytes.NewReader(entry.body))
+	return &obj, true, stale
+}
+
+// lookup returns the entry for the key and whether it is stale. Entries
+// are never modified once added, so the caller may read them without
+// the lock.
+func (oc *objectCache) lookup(key string) (*cacheEntry, bool, bool) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	elem, found := oc.items[key]
+	if !found {
+		return nil, false, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.expires.Add(oc.stale)) {
+		oc.remove(elem)
+		return nil, false, false
+	}
+	oc.ll.MoveToFront(elem)
+	return entry, true, now.After(entry.expires)
+}
+
+// startRefresh reports whether the caller should refresh the entry,
+// making sure only one refresh per key runs at a time.
+func (oc *objectCache) startRefresh(key string) bool {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	if oc.refreshing[key] {
+		return false
+	}
+	oc.refreshing[key] = true
+	return true
+}
+
+func (oc *objectCache) endRefresh(key string) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	delete(oc.refreshing, key)
+}
+
+// forget drops the entry for the key, if any.
+func (oc *objectCache) forget(key string) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	if elem, found := oc.items[key]; found {
+		oc.remove(elem)
+	}
+}
+
+func (oc *objectCache) add(key string, obj *s3.GetObjectOutput, body []byte) {
+	if int64(len(body)) > oc.maxBytes {
+		return
+	}
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	if elem, found := oc.items[key]; found {
+		oc.remove(elem)
+	}
+	entry := &cacheEntry{
+		key:     key,
+		obj:     *obj,
+		body:    body,
+		expires: time.Now().Add(oc.ttl),
+	}
+	entry.obj.Body = nil
+	oc.items[key] = oc.ll.PushFront(entry)
+	oc.size += int64(len(body))
+
+	for oc.size > oc.maxBytes {
+		oc.remove(oc.ll.Back())
+	}
+}
+
+func (oc *objectCache) remove(elem *list.Element) {
+	entry := oc.ll.Remove(elem).(*cacheEntry)
+	delete(oc.items, entry.key)
+	oc.size -= int64(len(entry.body))
+}
+
+// etagCache remembers the ETags served for immutable paths, so that
+// revalidations of those paths can be answered without asking S3.
+// It holds up to max entries, evicting the least recently used.
+type etagCache struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type etagEntry struct {
+	key  string
+	etag string
+}
+
+func newETagCache(max int) *etagCache {
+	return &etagCache{
+		max:   max,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (ec *etagCache) get(key string) (string, bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	elem, found := ec.items[key]
+	if !found {
+		return "", false
+	}
+	ec.ll.MoveToFront(elem)
+	return elem.Value.(*etagEntry).etag, true
+}
+
+func (ec *etagCache) add(key, etag string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if elem, found := ec.items[key]; found {
+		elem.Value.(*etagEntry).etag = etag
+		ec.ll.MoveToFront(elem)
+		return
+	}
+	ec.items[key] = ec.ll.PushFront(&etagEntry{key: key, etag: etag})
+	for ec.ll.Len() > ec.max {
+		entry := ec.ll.Remove(ec.ll.Back()).(*etagEntry)
+		delete(ec.items, entry.key)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestObjectCache(t *testing.T) {
+	small := strings.Repeat("s", 100)
+	large := strings.Repeat("l", 2000)
+	tests := []struct {
+		name string
+		body string
+		gets int
+	}{
+		{"small", small, 1},
+		{"too large", large, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{
+				"CACHE_MAX_BYTES":        "10000",
+				"CACHE_MAX_OBJECT_BYTES": "1000",
+				"CACHE_TTL":              "1m",
+			})
+			fake.put("bucket/file.txt", fakeObject{body: test.body, contentType: "text/plain"})
+			for i := 0; i < 3; i++ {
+				w := serve(newRequest("GET", "/file.txt"))
+				if w.Code != http.StatusOK || w.Body.String() != test.body {
+					t.Fatalf("request %d: got %d, %d bytes", i, w.Code, w.Body.Len())
+				}
+				if got := w.Header().Get("Content-Type"); got != "text/plain" {
+					t.Errorf("request %d: Content-Type = %q, want text/plain", i, got)
+				}
+			}
+			if n := fake.count("GetObject"); n != test.gets {
+				t.Errorf("%d GetObject calls, want %d", n, test.gets)
+			}
+		})
+	}
+}
+
+func TestObjectCacheBypass(t *testing.T) {
+	fake := setup(t, map[string]string{"CACHE_MAX_BYTES": "10000", "CACHE_MAX_OBJECT_BYTES": "1000"})
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+	serve(newRequest("GET", "/file.txt"))
+
+	// Ranged and conditional requests always go to S3
+	serve(newRequest("GET", "/file.txt", "Range", "bytes=0-1"))
+	serve(newRequest("GET", "/file.txt", "If-None-Match", `"other"`))
+	serve(newRequest("GET", "/file.txt", "If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat)))
+	if n := fake.count("GetObject"); n != 4 {
+		t.Errorf("%d GetObject calls, want 4", n)
+	}
+}
+
+func TestObjectCacheEviction(t *testing.T) {
+	oc := newObjectCache(10, time.Minute, 0)
+	obj := &s3.GetObjectOutput{ContentType: aws.String("text/plain")}
+	oc.add("a", obj, []byte("aaaa"))
+	oc.add("b", obj, []byte("bbbb"))
+	oc.get("a") // b is now the least recently used
+	oc.add("c", obj, []byte("cccc"))
+	oc.add("huge", obj, []byte("this is more than ten bytes"))
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "huge": false} {
+		if _, found, _ := oc.get(key); found != want {
+			t.Errorf("%s cached = %v, want %v", key, found, want)
+		}
+	}
+	if oc.size != 8 {
+		t.Errorf("size = %d, want 8", oc.size)
+	}
+}
+
+func TestObjectCacheExpiry(t *testing.T) {
+	oc := newObjectCache(100, -time.Second, 0)
+	oc.add("a", &s3.GetObjectOutput{}, []byte("aaaa"))
+	if _, found, _ := oc.get("a"); found {
+		t.Error("expired entry returned")
+	}
+}
+
+// waitForRefresh waits for background refreshes of the key to finish.
+func waitForRefresh(t *testing.T, key string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		objects.mu.Lock()
+		refreshing := objects.refreshing[key]
+		objects.mu.Unlock()
+		if !refreshing {
+			return
+		}
+	}
+	t.Fatalf("%s still refreshing", key)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		refresh string // served once the refresh is done
+	}{
+		{"refreshed", nil, "new"},
+		{"S3 down", s3Error("ServiceUnavailable", http.StatusServiceUnavailable), "old"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{
+				"CACHE_MAX_BYTES":        "1024",
+				"CACHE_TTL":              "20ms",
+				"STALE_WHILE_REVALIDATE": "60",
+			})
+			fake.put("bucket/file.txt", fakeObject{body: "old"})
+			serve(newRequest("GET", "/file.txt"))
+
+			fake.put("bucket/file.txt", fakeObject{body: "new"})
+			if test.err != nil {
+				fake.errors["bucket/file.txt"] = test.err
+			}
+			time.Sleep(30 * time.Millisecond)
+
+			// Expired entries are served straight away while S3 is asked again
+			if w := serve(newRequest("GET", "/file.txt")); w.Body.String() != "old" {
+				t.Errorf("stale entry: got %q, want old", w.Body.String())
+			}
+			waitForRefresh(t, "bucket//file.txt")
+			if n := fake.count("GetObject"); n != 2 {
+				t.Errorf("%d GetObject calls, want 2", n)
+			}
+			if w := serve(newRequest("GET", "/file.txt")); w.Body.String() != test.refresh {
+				t.Errorf("after the refresh: got %q, want %q", w.Body.String(), test.refresh)
+			}
+			// Serving the entry may have started another refresh
+			waitForRefresh(t, "bucket//file.txt")
+		})
+	}
+}
+
+func TestStaleWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		stale time.Duration
+		found bool
+		isOld bool
+	}{
+		{"fresh", time.Minute, time.Minute, true, false},
+		{"stale", -time.Second, time.Minute, true, true},
+		{"too old", -2 * time.Minute, time.Minute, false, false},
+		{"no stale window", -time.Second, 0, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oc := newObjectCache(100, test.ttl, test.stale)
+			oc.add("a", &s3.GetObjectOutput{}, []byte("aaaa"))
+			_, found, stale := oc.get("a")
+			if found != test.found || stale != test.isOld {
+				t.Errorf("found %v, stale %v, want %v, %v", found, stale, test.found, test.isOld)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Media types worth compressing. Images, archives and videos are
+// already compressed and only waste CPU.
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/x-javascript",
+	"application/json",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+func isCompressible(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	for _, candidate := range compressibleTypes {
+		if strings.HasPrefix(mediaType, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding reports whether the client listed the encoding
+// in its Accept-Encoding header without a zero quality value.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), encoding) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressible decides whether the object can be gzipped on the fly.
+// Objects of unknown length are compressed, small ones aren't worth it.
+func compressible(obj *s3.GetObjectOutput) bool {
+	if obj.ContentLength != nil && *obj.ContentLength <= c.gzipMinBytes {
+		return false
+	}
+	return len(aws.StringValue(obj.ContentEncoding)) == 0 &&
+		len(aws.StringValue(obj.ContentRange)) == 0 &&
+		isCompressible(aws.StringValue(obj.ContentType))
+}
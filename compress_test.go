@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gunzip decompresses a response body.
+func gunzip(t *testing.T, body string) string {
+	t.Helper()
+	gr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// gzipString compresses an object body.
+func gzipString(t *testing.T, body string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGzip(t *testing.T) {
+	html := strings.Repeat("<p>hello</p>", 200)
+	tests := []struct {
+		name           string
+		key            string
+		obj            fakeObject
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"html", "page.html", fakeObject{body: html, contentType: "text/html; charset=utf-8"}, "gzip, deflate", true},
+		{"jpeg", "photo.jpg", fakeObject{body: html, contentType: "image/jpeg"}, "gzip", false},
+		{"not accepted", "page.html", fakeObject{body: html, contentType: "text/html"}, "", false},
+		{"refused", "page.html", fakeObject{body: html, contentType: "text/html"}, "gzip;q=0", false},
+		{"encoded", "app.js", fakeObject{body: html, contentType: "application/javascript", contentEncoding: "br"}, "gzip, br", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"GZIP_ENABLED": "true"})
+			fake.put("bucket/"+test.key, test.obj)
+			w := serve(newRequest("GET", "/"+test.key, "Accept-Encoding", test.acceptEncoding))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", w.Code)
+			}
+			if test.gzipped {
+				if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+					t.Errorf("Content-Encoding = %q, want gzip", got)
+				}
+				if got := w.Header().Get("Content-Length"); len(got) > 0 {
+					t.Errorf("Content-Length = %q, want none", got)
+				}
+				if got := gunzip(t, w.Body.String()); got != test.obj.body {
+					t.Errorf("inflated body = %q, want %q", got, test.obj.body)
+				}
+				return
+			}
+			if got := w.Header().Get("Content-Encoding"); got != test.obj.contentEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, test.obj.contentEncoding)
+			}
+			if w.Body.String() != test.obj.body {
+				t.Errorf("body changed: %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"br", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		r := newRequest("GET", "/", "Accept-Encoding", test.header)
+		if got := acceptsEncoding(r, "gzip"); got != test.want {
+			t.Errorf("acceptsEncoding(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestPrecompressedGzip(t *testing.T) {
+	tests := []struct {
+		name           string
+		variant        *fakeObject
+		variantErr     error
+		acceptEncoding string
+		body           string
+		encoding       string
+	}{
+		{"hit", &fakeObject{body: "zipped"}, nil, "gzip", "zipped", "gzip"},
+		{"missing variant", nil, nil, "gzip", "plain", ""},
+		{"denied variant", &fakeObject{body: "zipped"}, s3Error("AccessDenied", 403), "gzip", "plain", ""},
+		{"not accepted", &fakeObject{body: "zipped"}, nil, "identity", "plain", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"SERVE_PRECOMPRESSED": "true"})
+			fake.put("bucket/app.js", fakeObject{body: "plain", contentType: "application/javascript"})
+			if test.variant != nil {
+				fake.put("bucket/app.js.gz", *test.variant)
+			}
+			if test.variantErr != nil {
+				fake.errors["bucket/app.js.gz"] = test.variantErr
+			}
+			w := serve(newRequest("GET", "/app.js", "Accept-Encoding", test.acceptEncoding))
+			if w.Code != http.StatusOK || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), test.body)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != test.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, test.encoding)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.Contains(got, "javascript") {
+				t.Errorf("Content-Type = %q, want the type of app.js", got)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+		})
+	}
+}
+
+func TestPrecompressedBrotli(t *testing.T) {
+	tests := []struct {
+		name           string
+		variants       []string
+		denied         string
+		acceptEncoding string
+		body           string
+		encoding       string
+	}{
+		{"brotli", []string{"br", "gz"}, "", "gzip, deflate, br", "br", "br"},
+		{"brotli only", []string{"br"}, "", "br", "br", "br"},
+		{"gzip fallback", []string{"gz"}, "", "gzip, br", "gz", "gzip"},
+		{"brotli denied", []string{"br", "gz"}, "br", "gzip, br", "gz", "gzip"},
+		{"brotli refused", []string{"br", "gz"}, "", "gzip, br;q=0", "gz", "gzip"},
+		{"gzip only accepted", []string{"br", "gz"}, "", "gzip", "gz", "gzip"},
+		{"neither accepted", []string{"br", "gz"}, "", "deflate", "plain", ""},
+		{"no variants", nil, "", "gzip, br", "plain", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"SERVE_PRECOMPRESSED": "true"})
+			fake.put("bucket/app.js", fakeObject{body: "plain", contentType: "application/javascript"})
+			for _, extension := range test.variants {
+				fake.put("bucket/app.js."+extension, fakeObject{body: extension, contentType: "application/octet-stream"})
+			}
+			if len(test.denied) > 0 {
+				fake.errors["bucket/app.js."+test.denied] = s3Error("AccessDenied", 403)
+			}
+			w := serve(newRequest("GET", "/app.js", "Accept-Encoding", test.acceptEncoding))
+			if w.Code != http.StatusOK || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), test.body)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != test.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, test.encoding)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.Contains(got, "javascript") {
+				t.Errorf("Content-Type = %q, want the type of app.js", got)
+			}
+		})
+	}
+}
+
+func TestInflate(t *testing.T) {
+	text := strings.Repeat("hello ", 100)
+	stored := gzipString(t, text)
+	tests := []struct {
+		name           string
+		body           string
+		acceptEncoding string
+		rangeHeader    string
+		status         int
+		want           string // the body the client gets
+		encoding       string
+		length         string
+	}{
+		{"inflated", stored, "", "", http.StatusOK, text, "", ""},
+		{"identity only", stored, "identity", "", http.StatusOK, text, "", ""},
+		{"refused", stored, "gzip;q=0", "", http.StatusOK, text, "", ""},
+		{"passed through", stored, "gzip, br", "", http.StatusOK, stored, "gzip", strconv.Itoa(len(stored))},
+		{"range", stored, "", "bytes=0-9", http.StatusPartialContent, stored[:10], "gzip", "10"},
+		{"corrupt", "not gzip", "", "", http.StatusBadGateway, "invalid gzip encoded object\n", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/app.js", fakeObject{body: test.body, contentType: "application/javascript", contentEncoding: "gzip"})
+			w := serve(newRequest("GET", "/app.js", "Accept-Encoding", test.acceptEncoding, "Range", test.rangeHeader))
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			if w.Body.String() != test.want {
+				t.Errorf("body = %q, want %q", w.Body.String(), test.want)
+			}
+			if w.Code == http.StatusBadGateway {
+				return
+			}
+			if got := w.Header().Get("Content-Encoding"); got != test.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, test.encoding)
+			}
+			if got := w.Header().Get("Content-Length"); got != test.length {
+				t.Errorf("Content-Length = %q, want %q", got, test.length)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+		})
+	}
+}
+
+func TestGzipMinBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		minBytes string
+		size     int
+		gzipped  bool
+	}{
+		{"small", "", 1000, false},
+		{"at the default", "", 1024, false},
+		{"large", "", 1025, true},
+		{"lower threshold", "100", 1000, true},
+		{"no threshold", "0", 1, true},
+		{"invalid", "lots", 1000, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"GZIP_ENABLED": "true", "GZIP_MIN_BYTES": test.minBytes})
+			body := strings.Repeat("a", test.size)
+			fake.put("bucket/file.txt", fakeObject{body: body, contentType: "text/plain"})
+			w := serve(newRequest("GET", "/file.txt", "Accept-Encoding", "gzip"))
+			if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != test.gzipped {
+				t.Fatalf("gzipped = %v, want %v", gzipped, test.gzipped)
+			}
+			if test.gzipped {
+				if got := gunzip(t, w.Body.String()); got != body {
+					t.Errorf("inflated %d bytes, want %d", len(got), len(body))
+				}
+				return
+			}
+			if w.Body.String() != body {
+				t.Errorf("body changed")
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(test.size) {
+				t.Errorf("Content-Length = %q, want %d", got, test.size)
+			}
+		})
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	tests := []struct {
+		level string
+		xfl   byte // the gzip header's extra flags record the fastest and best levels
+	}{
+		{"", 0},
+		{"default", 0},
+		{"1", 4},
+		{"6", 0},
+		{"9", 2},
+	}
+	for _, test := range tests {
+		t.Run(test.level, func(t *testing.T) {
+			fake := setup(t, map[string]string{"GZIP_ENABLED": "true", "GZIP_LEVEL": test.level})
+			html := strings.Repeat("<p>hello</p>", 200)
+			fake.put("bucket/page.html", fakeObject{body: html, contentType: "text/html"})
+			w := serve(newRequest("GET", "/page.html", "Accept-Encoding", "gzip"))
+			if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", got)
+			}
+			if got := w.Body.Bytes()[8]; got != test.xfl {
+				t.Errorf("XFL = %d, want %d", got, test.xfl)
+			}
+			if got := gunzip(t, w.Body.String()); got != html {
+				t.Errorf("inflated body = %q", got)
+			}
+		})
+	}
+}
+
+func TestGzipLevelInvalid(t *testing.T) {
+	for _, level := range []string{"0", "10", "-1", "fast"} {
+		t.Run(level, func(t *testing.T) {
+			if out := configFails(t, map[string]string{"GZIP_LEVEL": level}); !strings.Contains(out, "GZIP_LEVEL") {
+				t.Errorf("GZIP_LEVEL=%s logged %q", level, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadConfigFile reads a YAML or JSON file mapping environment variable
+// names to values, such as AWS_S3_BUCKET: my-bucket. Each value is only
+// applied when the variable isn't already set, so the environment always
+// takes precedence over the file.
+func loadConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// JSON is a subset of YAML, so one decoder handles both
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	for key, value := range values {
+		switch value.(type) {
+		case string, bool, int, int64, float64:
+		default:
+			return fmt.Errorf("%s: only scalar values are supported", key)
+		}
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, fmt.Sprint(value))
+		}
+	}
+	return nil
+}
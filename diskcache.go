@@ -0,0 +1,282 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// diskCache keeps whole objects on local disk, so that they can still be
+// served during brief S3 outages. Each object is stored as a data file
+// next to a JSON file holding its metadata, named after the bucket, key
+// and ETag. The least recently used objects are evicted past maxBytes.
+type diskCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type diskEntry struct {
+	Key  string             `json:"key"`
+	Obj  s3.GetObjectOutput `json:"object"`
+	name string
+	size int64
+}
+
+// newDiskCache creates the cache directory if needed and indexes the
+// objects left there by a previous run.
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	dc := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+	// Downloads interrupted by a restart are never completed
+	if tmps, err := filepath.Glob(filepath.Join(dir, "tmp-*")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+	metas, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range metas {
+		name := strings.TrimSuffix(filepath.Base(meta), ".json")
+		data, err := ioutil.ReadFile(meta)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		entry := &diskEntry{}
+		if err != nil || json.Unmarshal(data, entry) != nil || len(entry.Key) == 0 {
+			os.Remove(meta)
+			continue
+		}
+		entry.name = name
+		entry.size = info.Size()
+		dc.mu.Lock()
+		dc.insert(entry)
+		dc.mu.Unlock()
+	}
+	return dc, nil
+}
+
+// lookup returns the entry for the key, marking it as recently used.
+func (dc *diskCache) lookup(key string) (*diskEntry, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	elem, found := dc.items[key]
+	if !found {
+		return nil, false
+	}
+	dc.ll.MoveToFront(elem)
+	return elem.Value.(*diskEntry), true
+}
+
+// open returns the cached object with its body read from disk.
+func (dc *diskCache) open(entry *diskEntry) (*s3.GetObjectOutput, error) {
+	file, err := os.Open(filepath.Join(dc.dir, entry.name))
+	if err != nil {
+		return nil, err
+	}
+	obj := entry.Obj
+	obj.Body = file
+	return &obj, nil
+}
+
+// add moves a completely downloaded temp file into the cache.
+func (dc *diskCache) add(key string, obj *s3.GetObjectOutput, tmp string, size int64) error {
+	sum := sha256.Sum256([]byte(key + "\x00" + aws.StringValue(obj.ETag)))
+	entry := &diskEntry{
+		Key:  key,
+		Obj:  *obj,
+		name: hex.EncodeToString(sum[:]),
+		size: size,
+	}
+	entry.Obj.Body = nil
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if elem, found := dc.items[key]; found {
+		dc.remove(elem)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dc.dir, entry.name+".json"), meta, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dc.dir, entry.name)); err != nil {
+		os.Remove(filepath.Join(dc.dir, entry.name+".json"))
+		return err
+	}
+	dc.insert(entry)
+	return nil
+}
+
+// insert indexes an entry and evicts old ones. dc.mu must be held.
+func (dc *diskCache) insert(entry *diskEntry) {
+	if elem, found := dc.items[entry.Key]; found {
+		dc.remove(elem)
+	}
+	dc.items[entry.Key] = dc.ll.PushFront(entry)
+	dc.size += entry.size
+
+	for dc.size > dc.maxBytes && dc.ll.Len() > 0 {
+		dc.remove(dc.ll.Back())
+	}
+}
+
+// forget drops the entry for the key, if any.
+func (dc *diskCache) forget(key string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if elem, found := dc.items[key]; found {
+		dc.remove(elem)
+	}
+}
+
+// remove deletes an entry and its files. Readers that already opened
+// the data file can still finish. dc.mu must be held.
+func (dc *diskCache) remove(elem *list.Element) {
+	entry := dc.ll.Remove(elem).(*diskEntry)
+	delete(dc.items, entry.Key)
+	dc.size -= entry.size
+	os.Remove(filepath.Join(dc.dir, entry.name))
+	os.Remove(filepath.Join(dc.dir, entry.name+".json"))
+}
+
+// s3getDisk serves an object from the disk cache after revalidating it
+// against S3 with If-None-Match, and If-Modified-Since for when ETags are
+// synthetic and If-None-Match isn't forwarded. When S3 can't be reached the cached copy
+// is served anyway, but not when S3 refuses access to it. On a miss the object is streamed to the client while
+// being written to a temp file, which joins the cache once complete.
+func s3getDisk(ctx context.Context, backet, key string) (*s3.GetObjectOutput, error) {
+	cacheKey := backet + "/" + key
+	entry, found := disk.lookup(cacheKey)
+	var obj *s3.GetObjectOutput
+	var err error
+	if found {
+		h := http.Header{}
+		h.Set("If-None-Match", aws.StringValue(entry.Obj.ETag))
+		if entry.Obj.LastModified != nil {
+			h.Set("If-Modified-Since", entry.Obj.LastModified.UTC().Format(http.TimeFormat))
+		}
+		obj, err = s3get(ctx, backet, key, "", h)
+	} else {
+		obj, err = s3getFull(ctx, backet, key)
+	}
+	if found && isNoSuchKey(err) {
+		disk.forget(cacheKey)
+		return nil, err
+	}
+	if found && (isNotModified(err) || isUnavailable(err)) && ctx.Err() == nil {
+		if !isNotModified(err) {
+			log.Printf("[cache] serving %s from disk: %v", cacheKey, err)
+		}
+		if cached, err := disk.open(entry); err == nil {
+			return cached, nil
+		}
+		// The file went missing, so fall back to a plain fetch
+		disk.forget(cacheKey)
+		obj, err = s3getFull(ctx, backet, key)
+	}
+	if err != nil || obj.ContentLength == nil || *obj.ContentLength > disk.maxBytes {
+		return obj, err
+	}
+
+	tmp, err := ioutil.TempFile(disk.dir, "tmp-")
+	if err != nil {
+		return obj, nil
+	}
+	// Keep the metadata as S3 sent it, the caller may rewrite headers
+	meta := *obj
+	obj.Body = &diskFiller{
+		body: obj.Body,
+		file: tmp,
+		done: func(size int64, complete bool) {
+			if !complete || size != aws.Int64Value(meta.ContentLength) {
+				os.Remove(tmp.Name())
+				return
+			}
+			if err := disk.add(cacheKey, &meta, tmp.Name(), size); err != nil {
+				log.Printf("[cache] %s: %v", cacheKey, err)
+				os.Remove(tmp.Name())
+			}
+		},
+	}
+	return obj, nil
+}
+
+// diskFiller copies an object body into a temp file as it is read.
+// done is called on Close, with whether the whole body was read.
+type diskFiller struct {
+	body    io.ReadCloser
+	file    *os.File
+	written int64
+	eof     bool
+	failed  bool
+	done    func(size int64, complete bool)
+}
+
+func (df *diskFiller) Read(p []byte) (int, error) {
+	n, err := df.body.Read(p)
+	if n > 0 && !df.failed {
+		if _, werr := df.file.Write(p[:n]); werr != nil {
+			df.failed = true
+		}
+		df.written += int64(n)
+	}
+	if err == io.EOF {
+		df.eof = true
+	}
+	return n, err
+}
+
+func (df *diskFiller) Close() error {
+	err := df.body.Close()
+	if cerr := df.file.Close(); cerr != nil {
+		df.failed = true
+	}
+	df.done(df.written, df.eof && !df.failed)
+	return err
+}
+
+// isUnavailable reports whether S3 failed to answer, as opposed to
+// answering with an error about the object: transport errors, server
+// errors and throttling.
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		return rerr.StatusCode() >= http.StatusInternalServerError || rerr.StatusCode() == http.StatusTooManyRequests
+	}
+	return true
+}
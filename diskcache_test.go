@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	fake := setup(t, map[string]string{"DISK_CACHE_DIR": dir})
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+
+	get := func(want string) {
+		t.Helper()
+		w := serve(newRequest("GET", "/file.txt"))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("got %d %q, want %q", w.Code, w.Body.String(), want)
+		}
+	}
+
+	// A miss streams from S3 and writes the object to disk
+	get("hello")
+	if entry, found := disk.lookup("bucket//file.txt"); !found {
+		t.Fatal("object not written to disk")
+	} else if data, _ := ioutil.ReadFile(filepath.Join(dir, entry.name)); string(data) != "hello" {
+		t.Errorf("cached %q", data)
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "tmp-*")); len(tmps) > 0 {
+		t.Errorf("temp files left behind: %q", tmps)
+	}
+
+	// A hit is served from disk once S3 confirms it's current
+	get("hello")
+
+	// The cached copy survives S3 outages
+	fake.errors["bucket/file.txt"] = s3Error("ServiceUnavailable", http.StatusServiceUnavailable)
+	get("hello")
+	delete(fake.errors, "bucket/file.txt")
+
+	// Changed objects replace the cached copy
+	fake.put("bucket/file.txt", fakeObject{body: "changed"})
+	get("changed")
+	fake.errors["bucket/file.txt"] = s3Error("ServiceUnavailable", http.StatusServiceUnavailable)
+	get("changed")
+	delete(fake.errors, "bucket/file.txt")
+
+	// Deleted objects are forgotten
+	delete(fake.objects, "bucket/file.txt")
+	if w := serve(newRequest("GET", "/file.txt")); w.Code != http.StatusNotFound {
+		t.Errorf("deleted object: status = %d, want 404", w.Code)
+	}
+	if _, found := disk.lookup("bucket//file.txt"); found {
+		t.Error("deleted object still cached")
+	}
+}
+
+func TestDiskCacheRevalidation(t *testing.T) {
+	fake := setup(t, map[string]string{"DISK_CACHE_DIR": t.TempDir()})
+	fake.put("bucket/file.txt", fakeObject{body: "hello", etag: `"v1"`})
+	serve(newRequest("GET", "/file.txt"))
+
+	w := serve(newRequest("GET", "/file.txt"))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+	if len(fake.gets) != 2 {
+		t.Fatalf("%d GetObject calls, want 2", len(fake.gets))
+	}
+	if fake.gets[0].IfNoneMatch != nil {
+		t.Errorf("miss sent If-None-Match %q", *fake.gets[0].IfNoneMatch)
+	}
+	if got := aws.StringValue(fake.gets[1].IfNoneMatch); got != `"v1"` {
+		t.Errorf("hit sent If-None-Match %q, want the cached ETag", got)
+	}
+	if fake.gets[1].IfModifiedSince == nil || !fake.gets[1].IfModifiedSince.Equal(lastModified) {
+		t.Errorf("hit sent If-Modified-Since %v, want %v", fake.gets[1].IfModifiedSince, lastModified)
+	}
+}
+
+func TestDiskCacheFallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		body   string
+	}{
+		{"unavailable", s3Error("ServiceUnavailable", http.StatusServiceUnavailable), http.StatusOK, "hello"},
+		{"internal error", s3Error("InternalError", http.StatusInternalServerError), http.StatusOK, "hello"},
+		{"throttled", s3Error("SlowDown", http.StatusServiceUnavailable), http.StatusOK, "hello"},
+		{"unreachable", awserr.New("RequestError", "send request failed", nil), http.StatusOK, "hello"},
+		{"access denied", s3Error("AccessDenied", http.StatusForbidden), http.StatusForbidden, "Forbidden\n"},
+		{"bucket gone", s3Error(s3.ErrCodeNoSuchBucket, http.StatusNotFound), http.StatusNotFound, "Not Found\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"DISK_CACHE_DIR": t.TempDir()})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			serve(newRequest("GET", "/file.txt"))
+
+			fake.errors["bucket/file.txt"] = test.err
+			w := serve(newRequest("GET", "/file.txt"))
+			if w.Code != test.status || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), test.status, test.body)
+			}
+		})
+	}
+}
+
+func TestDiskCacheSSECustomerKey(t *testing.T) {
+	out := configFails(t, map[string]string{
+		"DISK_CACHE_DIR": t.TempDir(),
+		"SSE_C_KEY":      "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+	})
+	if !strings.Contains(out, "DISK_CACHE_DIR can't be used with SSE_C_KEY") {
+		t.Errorf("unexpected error: %s", out)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	fake := setup(t, map[string]string{"DISK_CACHE_DIR": dir, "DISK_CACHE_MAX_BYTES": "10"})
+	for _, key := range []string{"a", "b", "c"} {
+		fake.put("bucket/"+key, fakeObject{body: "12345"})
+		serve(newRequest("GET", "/"+key))
+	}
+	// Too large to ever be cached
+	fake.put("bucket/large", fakeObject{body: "12345678901"})
+	serve(newRequest("GET", "/large"))
+
+	for key, cached := range map[string]bool{"a": false, "b": true, "c": true, "large": false} {
+		if _, found := disk.lookup("bucket//" + key); found != cached {
+			t.Errorf("%s: cached = %v, want %v", key, found, cached)
+		}
+	}
+	if disk.size != 10 {
+		t.Errorf("size = %d, want 10", disk.size)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 4 {
+		t.Errorf("files %q, want data and metadata for two objects", files)
+	}
+
+	// A restart picks up what's on disk
+	dc, err := newDiskCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "c"} {
+		entry, found := dc.lookup("bucket//" + key)
+		if !found || entry.size != 5 || aws.StringValue(entry.Obj.ETag) == "" {
+			t.Errorf("%s not reloaded: %+v", key, entry)
+		}
+	}
+}
+
+func TestDiskCacheIncomplete(t *testing.T) {
+	dir := t.TempDir()
+	fake := setup(t, map[string]string{"DISK_CACHE_DIR": dir})
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+
+	// The client goes away after the first bytes
+	obj, err := s3getDisk(newRequest("GET", "/").Context(), "bucket", "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Body.Read(make([]byte, 2))
+	obj.Body.Close()
+
+	if _, found := disk.lookup("bucket//file.txt"); found {
+		t.Error("partial download was cached")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) > 0 {
+		t.Errorf("files left behind: %q", files)
+	}
+}
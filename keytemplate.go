@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// keyTemplate rewrites request paths into S3 keys when KEY_TEMPLATE is set.
+var keyTemplate *template.Template
+
+// keyTemplateFuncs are available to KEY_TEMPLATE, for example:
+//
+//	{{if hasPrefix .Path "/api/v1/"}}/api/{{trimPrefix .Path "/api/v1/"}}.json{{else}}{{.Path}}{{end}}
+var keyTemplateFuncs = template.FuncMap{
+	"hasPrefix":  strings.HasPrefix,
+	"hasSuffix":  strings.HasSuffix,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"replace":    strings.Replace,
+	"default": func(fallback, value string) string {
+		if len(value) == 0 {
+			return fallback
+		}
+		return value
+	},
+}
+
+// keyTemplateData is what KEY_TEMPLATE is executed against.
+type keyTemplateData struct {
+	Path string // the request path after routing, such as /posts/123
+	Host string
+}
+
+func parseKeyTemplate(text string) (*template.Template, error) {
+	return template.New("KEY_TEMPLATE").Funcs(keyTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// applyKeyTemplate returns the path with KEY_TEMPLATE applied. The result
+// is relative to the key prefix, and always starts with a slash.
+func applyKeyTemplate(r *http.Request, path string) (string, error) {
+	var buf bytes.Buffer
+	if err := keyTemplate.Execute(&buf, keyTemplateData{Path: path, Host: r.Host}); err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(buf.String())
+	if !strings.HasPrefix(key, "/") {
+		key = "/" + key
+	}
+	return key, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	rules := `{{if hasPrefix .Path "/api/v1/"}}api/{{trimPrefix .Path "/api/v1/"}}.json` +
+		`{{else if hasPrefix .Path "/posts/"}}{{trimSuffix .Path "/"}}/index.html` +
+		`{{else}}{{.Path}}{{end}}`
+	tests := []struct {
+		name     string
+		template string
+		path     string
+		key      string
+	}{
+		{"api", rules, "/api/v1/x", "bucket/api/x.json"},
+		{"post", rules, "/posts/123", "bucket/posts/123/index.html"},
+		// The index document is added before the template runs
+		{"directory", rules, "/docs/", "bucket/docs/index.html"},
+		{"unchanged", rules, "/file.txt", "bucket/file.txt"},
+		{"default", `{{default "/fallback.txt" (trimPrefix .Path "/file.txt")}}`, "/file.txt", "bucket/fallback.txt"},
+		{"host", `/{{.Host}}{{.Path}}`, "/file.txt", "bucket/example.com/file.txt"},
+		{"no template", "", "/posts/123", "bucket/posts/123"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"KEY_TEMPLATE": test.template})
+			fake.put(test.key, fakeObject{body: "hello"})
+			w := serve(newRequest("GET", "http://example.com"+test.path))
+			if w.Code != http.StatusOK || w.Body.String() != "hello" {
+				t.Errorf("got %d %q, want the object at %s", w.Code, w.Body.String(), test.key)
+			}
+		})
+	}
+}
+
+func TestKeyTemplateErrors(t *testing.T) {
+	if out := configFails(t, map[string]string{"KEY_TEMPLATE": "{{.Path"}); !strings.Contains(out, "KEY_TEMPLATE") {
+		t.Errorf("unparsable template: %s", out)
+	}
+
+	// Fields that don't exist only fail once executed
+	setup(t, map[string]string{"KEY_TEMPLATE": "{{.Missing}}"})
+	if w := serve(newRequest("GET", "/file.txt")); w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500", w.Code)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type jsonDirectoryEntry struct {
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	IsPrefix     bool       `json:"isPrefix"`
+}
+
+type jsonDirectoryListing struct {
+	Entries           []jsonDirectoryEntry `json:"entries"`
+	ContinuationToken string               `json:"continuationToken,omitempty"`
+}
+
+type directoryEntry struct {
+	Name         string
+	Href         string
+	Size         int64
+	LastModified time.Time
+	IsPrefix     bool
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Last modified</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td>{{if .IsPrefix}}<td>-</td><td>-</td>{{else}}<td>{{.Size}}</td><td>{{.LastModified.UTC.Format "2006-01-02 15:04:05"}}</td>{{end}}</tr>
+{{end}}</table>
+{{if .Next}}<p><a href="?continuationToken={{.Next}}">Next page</a></p>
+{{end}}</body>
+</html>
+`))
+
+// listDirectory renders the objects and sub-folders directly under
+// the key prefix as an HTML page, or as JSON if the client prefers.
+// Large folders are paginated with the continuationToken query parameter.
+// Nothing is written for an empty folder, which is reported as false so
+// that the caller can respond with a 404 instead.
+func listDirectory(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, prefix string) bool {
+	prefix = strings.TrimPrefix(prefix, "/")
+	req := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	if token := r.URL.Query().Get("continuationToken"); len(token) > 0 {
+		req.ContinuationToken = aws.String(token)
+	}
+	out, err := s3For(bucket).ListObjectsV2WithContext(ctx, req)
+	if err != nil && relocate(ctx, bucket, err) {
+		out, err = s3For(bucket).ListObjectsV2WithContext(ctx, req)
+	}
+	if err != nil {
+		code, message := toHTTPError(err)
+		http.Error(w, message, code)
+		return true
+	}
+	if len(out.Contents) == 0 && len(out.CommonPrefixes) == 0 && req.ContinuationToken == nil {
+		return false
+	}
+
+	entries := []directoryEntry{}
+	for _, p := range out.CommonPrefixes {
+		name := strings.TrimPrefix(aws.StringValue(p.Prefix), prefix)
+		entries = append(entries, directoryEntry{
+			Name:     name,
+			Href:     "./" + url.PathEscape(strings.TrimSuffix(name, "/")) + "/",
+			IsPrefix: true,
+		})
+	}
+	for _, obj := range out.Contents {
+		name := strings.TrimPrefix(aws.StringValue(obj.Key), prefix)
+		if len(name) == 0 {
+			continue // the folder placeholder itself
+		}
+		entries = append(entries, directoryEntry{
+			Name:         name,
+			Href:         "./" + url.PathEscape(name),
+			Size:         aws.Int64Value(obj.Size),
+			LastModified: aws.TimeValue(obj.LastModified),
+		})
+	}
+
+	next := ""
+	if aws.BoolValue(out.IsTruncated) {
+		next = aws.StringValue(out.NextContinuationToken)
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		listing := jsonDirectoryListing{
+			Entries:           []jsonDirectoryEntry{},
+			ContinuationToken: next,
+		}
+		for _, entry := range entries {
+			item := jsonDirectoryEntry{
+				Key:      r.URL.Path + entry.Name,
+				Size:     entry.Size,
+				IsPrefix: entry.IsPrefix,
+			}
+			if !entry.IsPrefix {
+				item.LastModified = aws.Time(entry.LastModified)
+			}
+			listing.Entries = append(listing.Entries, item)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listing)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	listingTemplate.Execute(w, struct {
+		Path    string
+		Entries []directoryEntry
+		Next    string
+	}{r.URL.Path, entries, next})
+	return true
+}
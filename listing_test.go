@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// putTree stores objects under the given keys, each as long as its key.
+func (f *fakeS3) putTree(bucket string, keys ...string) {
+	for _, key := range keys {
+		f.put(bucket+"/"+key, fakeObject{body: strings.Repeat("x", len(key))})
+	}
+}
+
+func TestDirectoryListing(t *testing.T) {
+	fake := setup(t, map[string]string{"DIRECTORY_LISTING": "true"})
+	fake.putTree("bucket", "docs/", "docs/a.txt", "docs/sub/b.txt", "docs/sub/c/d.txt", "docs/z y.pdf", "other.txt")
+
+	w := serve(newRequest("GET", "/docs/"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`<title>Index of /docs/</title>`,
+		`<a href="../">../</a>`,
+		`<a href="./sub/">sub/</a>`,
+		`<a href="./a.txt">a.txt</a></td><td>10</td><td>2020-01-02 03:04:05</td>`,
+		`<a href="./z%20y.pdf">z y.pdf</a>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing lacks %s:\n%s", want, body)
+		}
+	}
+	for _, unwanted := range []string{"b.txt", "c/", "other.txt", `href="./"`} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("listing shows %s:\n%s", unwanted, body)
+		}
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
+
+func TestDirectoryListingOff(t *testing.T) {
+	fake := setup(t, map[string]string{"DIRECTORY_LISTING": "false"})
+	fake.putTree("bucket", "docs/a.txt")
+	if w := serve(newRequest("GET", "/docs/")); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+	if n := fake.count("ListObjectsV2"); n != 0 {
+		t.Errorf("%d listings, want none", n)
+	}
+}
+
+func TestDirectoryListingEmpty(t *testing.T) {
+	tests := []struct {
+		name          string
+		errorDocument string
+		body          string
+	}{
+		{"plain", "", "Not Found\n"},
+		{"error document", "/404.html", "lost"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"DIRECTORY_LISTING": "true", "ERROR_DOCUMENT_404": test.errorDocument})
+			fake.put("bucket/404.html", fakeObject{body: "lost"})
+			fake.putTree("bucket", "docs/a.txt")
+			w := serve(newRequest("GET", "/nothing/here/"))
+			if w.Code != http.StatusNotFound || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want 404 %q", w.Code, w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestDirectoryListingJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header []string
+	}{
+		{"accept", "/docs/", []string{"Accept", "application/json"}},
+		{"format", "/docs/?format=json", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"DIRECTORY_LISTING": "true"})
+			fake.putTree("bucket", "docs/a.txt", "docs/sub/b.txt")
+			w := serve(newRequest("GET", test.target, test.header...))
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			want := `{"entries":[` +
+				`{"key":"/docs/sub/","size":0,"isPrefix":true},` +
+				`{"key":"/docs/a.txt","size":10,"lastModified":"2020-01-02T03:04:05Z","isPrefix":false}]}` + "\n"
+			if w.Body.String() != want {
+				t.Errorf("listing = %s, want %s", w.Body.String(), want)
+			}
+		})
+	}
+}
+
+func TestDirectoryListingPages(t *testing.T) {
+	fake := setup(t, map[string]string{"DIRECTORY_LISTING": "true"})
+	fake.pageSize = 2
+	fake.putTree("bucket", "docs/a.txt", "docs/b.txt", "docs/c/d.txt", "docs/e.txt")
+
+	pages := [][]string{}
+	token := ""
+	for i := 0; i < 5; i++ {
+		target := "/docs/?format=json"
+		if len(token) > 0 {
+			target += "&continuationToken=" + url.QueryEscape(token)
+		}
+		listing := jsonDirectoryListing{}
+		w := serve(newRequest("GET", target))
+		if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+			t.Fatalf("page %d: %v: %s", i, err, w.Body.String())
+		}
+		page := []string{}
+		for _, entry := range listing.Entries {
+			page = append(page, entry.Key)
+		}
+		pages = append(pages, page)
+		if token = listing.ContinuationToken; len(token) == 0 {
+			break
+		}
+	}
+	want := [][]string{{"/docs/a.txt", "/docs/b.txt"}, {"/docs/c/", "/docs/e.txt"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+}
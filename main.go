@@ -1,50 +1,413 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	pathpkg "path"
 	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type config struct {
-	awsRegion        string // AWS_REGION
-	s3Bucket         string // AWS_S3_BUCKET
-	s3KeyPrefix      string // AWS_S3_KEY_PREFIX
-	httpCacheControl string // HTTP_CACHE_CONTROL (max-age=86400, no-cache ...)
-	httpExpires      string // HTTP_EXPIRES (Thu, 01 Dec 1994 16:00:00 GMT ...)
-	basicAuthUser    string // BASIC_AUTH_USER
-	basicAuthPass    string // BASIC_AUTH_PASS
-	port             string // APP_PORT
-	accessLog        bool   // ACCESS_LOG
-	sslCert          string // SSL_CERT_PATH
-	sslKey           string // SSL_KEY_PATH
+	awsRegion        string            // AWS_REGION
+	roleARN          string            // AWS_ROLE_ARN (assume this role via STS)
+	roleSessionName  string            // AWS_ROLE_SESSION_NAME
+	s3Bucket         string            // AWS_S3_BUCKET
+	bucketMap        map[string]string // BUCKET_MAP (foo.example.com=foo-assets,bar.example.com=bar-assets ...)
+	s3Endpoint       string            // S3_ENDPOINT (empty uses the default AWS endpoint)
+	s3Accelerate     bool              // S3_ACCELERATE (use S3 Transfer Acceleration)
+	s3KeyPrefixes    []string          // AWS_S3_KEY_PREFIX (tried in order: current,legacy ...)
+	sseCustomerKey   string            // SSE_C_KEY (base64 encoded 256-bit SSE-C key)
+	canaryPrefix     string            // CANARY_PREFIX (key prefix serving the canary share of clients)
+	canaryPercent    int               // CANARY_PERCENT (0 to 100)
+	urlPrefixStrip   string            // URL_PREFIX_STRIP (/downloads ...)
+	keyTemplate      string            // KEY_TEMPLATE (text/template producing the key from .Path)
+	pathRoutes       []pathRoute       // PATH_ROUTES (/site-a=bucket-a:prefix-a,/site-b=bucket-b ...)
+	rewriteRules     []rewriteRule     // REWRITE_RULES (^/old/(.*)$ /new/$1;^/blog$ /blog/ ...)
+	s3Timeout        time.Duration     // S3_TIMEOUT (seconds, 0 means no timeout)
+	s3MaxRetries     int               // S3_MAX_RETRIES (-1 uses the SDK default)
+	debugS3          bool              // DEBUG_S3 (log every S3 API request and response, verbose)
+	maxConcurrent    int               // MAX_CONCURRENT_REQUESTS (0 means unlimited)
+	concurrencyWait  time.Duration     // CONCURRENCY_WAIT (how long to queue for a free slot)
+	copyBufferBytes  int               // COPY_BUFFER_BYTES (4KB to 16MB, defaults to 32KB)
+	indexDocument    string            // INDEX_DOCUMENT (index.html, index.htm ...)
+	disableIndex     bool              // DISABLE_INDEX (pass trailing-slash paths through verbatim)
+	directoryListing bool              // DIRECTORY_LISTING (list folders without an index document)
+	rootObject       string            // ROOT_OBJECT (served for / instead of the index document)
+	rootRedirect     string            // ROOT_REDIRECT (https://docs.example.com when / has nothing to serve)
+	rootStatus       int               // ROOT_STATUS (403, 404:Nothing to see here ...)
+	rootMessage      string            // ROOT_STATUS message (defaults to the status text)
+	allowVersions    bool              // ALLOW_VERSION_ACCESS (honor ?versionId=...)
+	directoryRedir   bool              // DIRECTORY_REDIRECT (redirect /dir to /dir/ when it's a folder)
+	spaMode          bool              // SPA_MODE
+	symlinkMaxDepth  int               // SYMLINK_MAX_DEPTH
+	symlinkPrefixes  []string          // SYMLINK_ALLOW_PREFIXES (/public/,/shared/ ...)
+	errorDocument404 string            // ERROR_DOCUMENT_404 (/404.html ...)
+	cacheMaxBytes    int64             // CACHE_MAX_BYTES (0 disables the in-memory cache)
+	cacheMaxObject   int64             // CACHE_MAX_OBJECT_BYTES
+	cacheTTL         time.Duration     // CACHE_TTL (30s, 5m ...)
+	staleRevalidate  time.Duration     // STALE_WHILE_REVALIDATE (seconds to serve expired entries while refreshing)
+	diskCacheDir     string            // DISK_CACHE_DIR (/var/cache/s3-proxy ...)
+	diskCacheBytes   int64             // DISK_CACHE_MAX_BYTES (defaults to 1GB)
+	rangeCacheBytes  int64             // RANGE_CACHE_BYTES (warm window kept per object, 0 disables)
+	rangeCacheMax    int64             // RANGE_CACHE_MAX_BYTES
+	parallelParts    int               // PARALLEL_DOWNLOAD_PARTS (concurrent ranged reads, 0 disables)
+	parallelPartSize int64             // PARALLEL_DOWNLOAD_PART_BYTES
+	parallelMinSize  int64             // PARALLEL_DOWNLOAD_THRESHOLD (only objects larger than this)
+	httpCacheControl string            // HTTP_CACHE_CONTROL (max-age=86400, no-cache ...)
+	cacheControls    []cacheRule       // CACHE_CONTROL_RULES (*.js=max-age=31536000|*.html=no-cache ...)
+	immutablePaths   []string          // IMMUTABLE_PATHS (/assets/*,*.woff2 ...)
+	httpExpires      string            // HTTP_EXPIRES (Thu, 01 Dec 1994 16:00:00 GMT ...)
+	syntheticETag    bool              // SYNTHETIC_ETAG (derive ETags from Last-Modified and size)
+	basicAuthUser    string            // BASIC_AUTH_USER
+	basicAuthPass    string            // BASIC_AUTH_PASS
+	basicAuthUsers   map[string]string // BASIC_AUTH_USERS (user1:pass1,user2:pass2 ...)
+	corsAllowOrigin  []string          // CORS_ALLOW_ORIGIN (*, https://example.com,https://example.org ...)
+	corsAllowMethods string            // CORS_ALLOW_METHODS (GET, HEAD ...)
+	corsAllowHeaders string            // CORS_ALLOW_HEADERS (Authorization, Range ...)
+	host             string            // APP_HOST (empty listens on all interfaces)
+	canonicalHost    string            // CANONICAL_HOST (www.example.com, other hosts get a 301)
+	ipAllow          []*net.IPNet      // IP_ALLOW_CIDRS (10.0.0.0/8,192.168.0.0/16 ...)
+	ipDeny           []*net.IPNet      // IP_DENY_CIDRS
+	trustedProxies   []*net.IPNet      // TRUSTED_PROXIES (peers allowed to set X-Forwarded-For or Forwarded)
+	clientIPHeaders  []string          // CLIENT_IP_HEADERS (X-Forwarded-For,Forwarded; the first present wins)
+	presignExpiry    time.Duration     // PRESIGN_EXPIRY (15m, 1h ...)
+	redirectBytes    int64             // REDIRECT_THRESHOLD_BYTES (redirect larger objects to S3)
+	maxObjectBytes   int64             // MAX_OBJECT_BYTES (larger responses get 413, 0 means unlimited)
+	oversizeRedirect bool              // MAX_OBJECT_REDIRECT (presign larger objects instead of 413)
+	customHeaders    map[string]string // CUSTOM_HEADERS (X-Frame-Options:DENY|X-Content-Type-Options:nosniff ...)
+	redirectsFile    string            // REDIRECTS_FILE (/etc/redirects.json, s3://bucket/redirects.json ...)
+	metadataHeaders  []string          // EXPOSE_METADATA_HEADERS (build-id,owner ...)
+	debugHeaders     bool              // DEBUG_HEADERS (send the resolved bucket and key)
+	serverHeader     string            // SERVER_HEADER (empty or none sends no Server header)
+	port             string            // APP_PORT (443 with TLS, 80 otherwise)
+	accessLog        bool              // ACCESS_LOG
+	slowRequest      time.Duration     // SLOW_REQUEST_MS (warn about slower requests even without ACCESS_LOG)
+	accessLogFormat  string            // ACCESS_LOG_FORMAT (text or json)
+	accessLogFile    string            // ACCESS_LOG_FILE (empty writes to stderr)
+	metricsEnabled   bool              // METRICS_ENABLED
+	gzipEnabled      bool              // GZIP_ENABLED
+	gzipMinBytes     int64             // GZIP_MIN_BYTES (smaller objects aren't compressed, defaults to 1024)
+	gzipLevel        int               // GZIP_LEVEL (1 fastest to 9 smallest, or default)
+	precompressed    bool              // SERVE_PRECOMPRESSED (serve key.br or key.gz when it exists)
+	sslCert          string            // SSL_CERT_PATH
+	sslKey           string            // SSL_KEY_PATH
+	httpRedirectPort string            // HTTP_REDIRECT_PORT (redirects plain HTTP to HTTPS, 80 with ACME_DOMAINS)
+	acmeDomains      []string          // ACME_DOMAINS (example.com,www.example.com ...)
+	acmeCacheDir     string            // ACME_CACHE_DIR (empty keeps certificates in memory only)
+	enableH2C        bool              // ENABLE_H2C (HTTP/2 without TLS, behind a terminating load balancer)
+	tlsMinVersion    uint16            // TLS_MIN_VERSION (1.0, 1.1, 1.2, 1.3)
+	tlsCipherSuites  []uint16          // TLS_CIPHER_SUITES (TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,...)
+	shutdownTimeout  time.Duration     // SHUTDOWN_TIMEOUT (30s, 1m ...)
+	headerTimeout    time.Duration     // READ_HEADER_TIMEOUT (defaults to 10s)
+	readTimeout      time.Duration     // READ_TIMEOUT (defaults to 30s)
+	writeTimeout     time.Duration     // WRITE_TIMEOUT (0 means no limit, so large downloads aren't cut off)
+	idleTimeout      time.Duration     // IDLE_TIMEOUT (defaults to 2m)
 }
 
+// cacheRule overrides Cache-Control for paths matching a glob
+// such as /assets/*.js or *.html, or an extension such as .css.
+type cacheRule struct {
+	pattern string
+	value   string
+}
+
+// pathRoute serves requests under pathPrefix from another bucket and key prefix.
+type pathRoute struct {
+	pathPrefix string
+	bucket     string
+	keyPrefix  string
+}
+
+// rewriteRule serves paths matching pattern from the key built by
+// expanding replacement, which may refer to capture groups as $1.
+type rewriteRule struct {
+	source      string // pattern as configured, for logging
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Symlink is the content of a symlink.json object. A request for
+// /foo/symlink.json/bar.html is served from URL + /bar.html.
 type Symlink struct {
 	URL string
 }
 
+const symlinkName = "symlink.json"
+
+var (
+	errSymlinkLoop      = errors.New("symlink loop detected")
+	errSymlinkForbidden = errors.New("symlink target not allowed")
+)
+
 var (
 	version string
 	date    string
 	c       *config
+	svc     s3iface.S3API
+	objects *objectCache
+	ranges  *objectCache
+	disk    *diskCache
+	etags   *etagCache
+	slots   chan struct{}
+	buffers = sync.Pool{New: func() interface{} {
+		buf := make([]byte, c.copyBufferBytes)
+		return &buf
+	}}
 )
 
 func main() {
+	validate := flag.Bool("validate", false, "check access to the configured buckets and exit")
+	flag.Parse()
+
 	c = configFromEnvironmentVariables()
+	client, err := newS3Client(c)
+	if err != nil {
+		log.Fatalf("[config] Failed to create AWS session: %v", err)
+	}
+	svc = client
+	if b, err := strconv.ParseBool(os.Getenv("VALIDATE_ONLY")); err == nil && b {
+		*validate = true
+	}
+	if *validate {
+		if !validateAccess() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if c.cacheMaxBytes > 0 {
+		objects = newObjectCache(c.cacheMaxBytes, c.cacheTTL, c.staleRevalidate)
+	}
+	if c.rangeCacheBytes > 0 {
+		ranges = newObjectCache(c.rangeCacheMax, c.cacheTTL, 0)
+	}
+	if len(c.immutablePaths) > 0 {
+		etags = newETagCache(10000)
+	}
+	if len(c.keyTemplate) > 0 {
+		keyTemplate = template.Must(parseKeyTemplate(c.keyTemplate))
+	}
+	if len(c.diskCacheDir) > 0 {
+		dc, err := newDiskCache(c.diskCacheDir, c.diskCacheBytes)
+		if err != nil {
+			log.Fatalf("[config] DISK_CACHE_DIR: %v", err)
+		}
+		disk = dc
+	}
+	if c.maxConcurrent > 0 {
+		slots = make(chan struct{}, c.maxConcurrent)
+	}
+	if len(c.redirectsFile) > 0 {
+		rules, err := loadRedirects(c.redirectsFile)
+		if err != nil {
+			log.Fatalf("[config] REDIRECTS_FILE: %v", err)
+		}
+		redirects = rules
+		log.Printf("[config] Loaded %d redirect rules", len(redirects))
+	}
+
+	if len(c.accessLogFile) > 0 {
+		if err := openAccessLog(c.accessLogFile); err != nil {
+			log.Fatalf("[config] ACCESS_LOG_FILE: %v", err)
+		}
+		// Reopen after logrotate has moved the file away
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go reopenOnSignal(hup, c.accessLogFile)
+	}
+
+	mux := newServeMux()
+
+	srv := newServer(mux)
+
+	// Obtain and renew certificates automatically. The HTTP-01
+	// challenge is answered by the redirector, on port 80 by default.
+	certManager := newCertManager()
+	if certManager != nil {
+		srv.TLSConfig.GetCertificate = certManager.GetCertificate
+	}
+	tlsEnabled := certManager != nil || ((len(c.sslCert) > 0) && (len(c.sslKey) > 0))
 
-	http.Handle("/", wrapper(awss3))
+	// Redirect plain HTTP to HTTPS
+	var redirector *http.Server
+	if tlsEnabled && (len(c.httpRedirectPort) > 0) {
+		redirector = newRedirector(c.httpRedirectPort, certManager)
+		go func() {
+			log.Printf("[service] redirecting HTTP on %s", redirector.Addr)
+			if err := redirector.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Graceful shutdown
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	idle := shutdownOnSignal(sig, redirector, srv)
+
+	// Listen & Serve. HTTP/2 is negotiated automatically over TLS.
+	log.Printf("[service] listening on %s", srv.Addr)
+	if certManager != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else if tlsEnabled {
+		err = srv.ListenAndServeTLS(c.sslCert, c.sslKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-idle
+}
+
+// shutdownOnSignal shuts the servers down in order once a signal arrives,
+// letting in-flight requests finish within SHUTDOWN_TIMEOUT. Nil servers
+// are skipped. The returned channel is closed when all are done.
+func shutdownOnSignal(sig <-chan os.Signal, servers ...*http.Server) <-chan struct{} {
+	idle := make(chan struct{})
+	go func() {
+		<-sig
+
+		log.Print("[service] shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+		defer cancel()
+		for _, srv := range servers {
+			if srv == nil {
+				continue
+			}
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("[service] shutdown: %v", err)
+			}
+		}
+		close(idle)
+	}()
+	return idle
+}
+
+// newServer builds the main server listening on APP_HOST and APP_PORT.
+// Slow clients can't hold connections open forever. ENABLE_H2C is only
+// accepted without TLS, so the handler can take h2c in any case.
+func newServer(handler http.Handler) *http.Server {
+	handler = withServerHeader(handler)
+	if c.enableH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return &http.Server{
+		Addr:              net.JoinHostPort(c.host, c.port),
+		Handler:           handler,
+		ReadHeaderTimeout: c.headerTimeout,
+		ReadTimeout:       c.readTimeout,
+		WriteTimeout:      c.writeTimeout,
+		IdleTimeout:       c.idleTimeout,
+		TLSConfig: &tls.Config{
+			MinVersion:   c.tlsMinVersion,
+			CipherSuites: c.tlsCipherSuites,
+		},
+	}
+}
+
+// newCertManager returns the manager obtaining certificates for
+// ACME_DOMAINS, or nil when they come from files or TLS is off.
+func newCertManager() *autocert.Manager {
+	if len(c.acmeDomains) == 0 {
+		return nil
+	}
+	certManager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.acmeDomains...),
+	}
+	if len(c.acmeCacheDir) > 0 {
+		certManager.Cache = autocert.DirCache(c.acmeCacheDir)
+	}
+	return certManager
+}
+
+// newRedirector builds the plain HTTP server redirecting to HTTPS, which
+// also answers HTTP-01 challenges when certManager isn't nil.
+func newRedirector(port string, certManager *autocert.Manager) *http.Server {
+	handler := http.Handler(http.HandlerFunc(redirectToHTTPS))
+	if certManager != nil {
+		handler = certManager.HTTPHandler(handler)
+	}
+	return &http.Server{
+		Addr:              net.JoinHostPort(c.host, port),
+		Handler:           withServerHeader(handler),
+		ReadHeaderTimeout: c.headerTimeout,
+		ReadTimeout:       c.readTimeout,
+		IdleTimeout:       c.idleTimeout,
+	}
+}
 
-	http.HandleFunc("/--version", func(w http.ResponseWriter, r *http.Request) {
+// withServerHeader sets SERVER_HEADER on every response of the handler,
+// or removes the header when it's empty.
+func withServerHeader(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(c.serverHeader) > 0 {
+			w.Header().Set("Server", c.serverHeader)
+		} else {
+			w.Header().Del("Server")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// newServeMux routes requests to the proxy and its service endpoints.
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", wrapper(awss3))
+
+	mux.HandleFunc("/--version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Version   string `json:"version"`
+				BuiltAt   string `json:"built_at"`
+				GoVersion string `json:"go_version"`
+			}{version, date, runtime.Version()})
+			return
+		}
 		if len(version) > 0 && len(date) > 0 {
 			fmt.Fprintf(w, "version: %s (built at %s)", version, date)
 		} else {
@@ -52,21 +415,36 @@ func main() {
 		}
 	})
 
-	// Listen & Serve
-	log.Printf("[service] listening on port %s", c.port)
-	if (len(c.sslCert) > 0) && (len(c.sslKey) > 0) {
-		log.Fatal(http.ListenAndServeTLS(":"+c.port, c.sslCert, c.sslKey, nil))
-	} else {
-		log.Fatal(http.ListenAndServe(":"+c.port, nil))
+	mux.HandleFunc("/healthz", healthz)
+
+	// Liveness and readiness probes, outside of basic auth and access logs
+	mux.HandleFunc("/--health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/--ready", healthz)
+
+	// Presigned URLs are only handed out to authenticated users
+	if len(c.basicAuthUsers) > 0 {
+		mux.Handle("/--presign/", wrapper(presign))
+	}
+
+	if c.metricsEnabled {
+		mux.Handle("/metrics", promhttp.Handler())
 	}
+	return mux
 }
 
 func configFromEnvironmentVariables() *config {
-	if len(os.Getenv("AWS_ACCESS_KEY_ID")) == 0 {
-		log.Print("Not defined environment variable: AWS_ACCESS_KEY_ID")
+	if path := os.Getenv("CONFIG_FILE"); len(path) > 0 {
+		if err := loadConfigFile(path); err != nil {
+			log.Fatalf("[config] CONFIG_FILE: %v", err)
+		}
+		log.Printf("[config] Loaded %v", path)
 	}
-	if len(os.Getenv("AWS_SECRET_ACCESS_KEY")) == 0 {
-		log.Print("Not defined environment variable: AWS_SECRET_ACCESS_KEY")
+	// Without static keys the default credential chain is used
+	// (shared config, web identity, ECS task role, EC2 instance profile)
+	if len(os.Getenv("AWS_ACCESS_KEY_ID")) == 0 || len(os.Getenv("AWS_SECRET_ACCESS_KEY")) == 0 {
+		log.Print("[config] No static AWS keys, using the default credential chain")
 	}
 	if len(os.Getenv("AWS_S3_BUCKET")) == 0 {
 		log.Fatal("Missing required environment variable: AWS_S3_BUCKET")
@@ -75,107 +453,1383 @@ func configFromEnvironmentVariables() *config {
 	if len(region) == 0 {
 		region = "us-east-1"
 	}
-	port := os.Getenv("APP_PORT")
-	if len(port) == 0 {
-		port = "80"
+	s3Accelerate := false
+	if b, err := strconv.ParseBool(os.Getenv("S3_ACCELERATE")); err == nil {
+		s3Accelerate = b
+	}
+	s3Timeout := time.Duration(0)
+	if n, err := strconv.Atoi(os.Getenv("S3_TIMEOUT")); err == nil && n > 0 {
+		s3Timeout = time.Duration(n) * time.Second
+	}
+	s3MaxRetries := aws.UseServiceDefaultRetries
+	if n, err := strconv.Atoi(os.Getenv("S3_MAX_RETRIES")); err == nil && n >= 0 {
+		s3MaxRetries = n
+	}
+	debugS3 := false
+	if b, err := strconv.ParseBool(os.Getenv("DEBUG_S3")); err == nil {
+		debugS3 = b
+	}
+	maxConcurrent := 0
+	if n, err := strconv.Atoi(os.Getenv("MAX_CONCURRENT_REQUESTS")); err == nil && n > 0 {
+		maxConcurrent = n
+	}
+	concurrencyWait := time.Second
+	if d, err := time.ParseDuration(os.Getenv("CONCURRENCY_WAIT")); err == nil && d >= 0 {
+		concurrencyWait = d
+	}
+	copyBufferBytes := 32 << 10
+	if n, err := strconv.Atoi(os.Getenv("COPY_BUFFER_BYTES")); err == nil {
+		if n >= 4<<10 && n <= 16<<20 {
+			copyBufferBytes = n
+		} else {
+			log.Printf("[config] Ignoring COPY_BUFFER_BYTES out of range: %d", n)
+		}
+	}
+	indexDocument := os.Getenv("INDEX_DOCUMENT")
+	if len(indexDocument) == 0 {
+		indexDocument = "index.html"
+	}
+	disableIndex := false
+	if b, err := strconv.ParseBool(os.Getenv("DISABLE_INDEX")); err == nil {
+		disableIndex = b
+	}
+	directoryListing := false
+	if b, err := strconv.ParseBool(os.Getenv("DIRECTORY_LISTING")); err == nil {
+		directoryListing = b
+	}
+	rootObject := os.Getenv("ROOT_OBJECT")
+	if len(rootObject) > 0 && !strings.HasPrefix(rootObject, "/") {
+		rootObject = "/" + rootObject
+	}
+	rootStatus, rootMessage := 0, ""
+	if value := os.Getenv("ROOT_STATUS"); len(value) > 0 {
+		parts := strings.SplitN(value, ":", 2)
+		code, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || code < 100 || code > 599 {
+			log.Fatalf("[config] ROOT_STATUS: invalid status %q", parts[0])
+		}
+		rootStatus, rootMessage = code, http.StatusText(code)
+		if len(parts) == 2 {
+			rootMessage = strings.TrimSpace(parts[1])
+		}
+	}
+	allowVersions := false
+	if b, err := strconv.ParseBool(os.Getenv("ALLOW_VERSION_ACCESS")); err == nil {
+		allowVersions = b
+	}
+	directoryRedir := false
+	if b, err := strconv.ParseBool(os.Getenv("DIRECTORY_REDIRECT")); err == nil {
+		directoryRedir = b
+	}
+	syntheticETag := false
+	if b, err := strconv.ParseBool(os.Getenv("SYNTHETIC_ETAG")); err == nil {
+		syntheticETag = b
 	}
 	accessLog := false
 	if b, err := strconv.ParseBool(os.Getenv("ACCESS_LOG")); err == nil {
 		accessLog = b
 	}
+	slowRequest := time.Duration(0)
+	if n, err := strconv.Atoi(os.Getenv("SLOW_REQUEST_MS")); err == nil && n > 0 {
+		slowRequest = time.Duration(n) * time.Millisecond
+	}
+	accessLogFormat := os.Getenv("ACCESS_LOG_FORMAT")
+	if accessLogFormat != "json" {
+		accessLogFormat = "text"
+	}
+	metricsEnabled := false
+	if b, err := strconv.ParseBool(os.Getenv("METRICS_ENABLED")); err == nil {
+		metricsEnabled = b
+	}
+	gzipEnabled := false
+	if b, err := strconv.ParseBool(os.Getenv("GZIP_ENABLED")); err == nil {
+		gzipEnabled = b
+	}
+	gzipMinBytes := int64(1024)
+	if n, err := strconv.ParseInt(os.Getenv("GZIP_MIN_BYTES"), 10, 64); err == nil && n >= 0 {
+		gzipMinBytes = n
+	}
+	gzipLevel := gzip.DefaultCompression
+	if value := os.Getenv("GZIP_LEVEL"); len(value) > 0 && value != "default" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < gzip.BestSpeed || n > gzip.BestCompression {
+			log.Fatalf("[config] GZIP_LEVEL must be 1 to 9 or default, not %q", value)
+		}
+		gzipLevel = n
+	}
+	precompressed := false
+	if b, err := strconv.ParseBool(os.Getenv("SERVE_PRECOMPRESSED")); err == nil {
+		precompressed = b
+	}
+	errorDocument404 := os.Getenv("ERROR_DOCUMENT_404")
+	if len(errorDocument404) > 0 && !strings.HasPrefix(errorDocument404, "/") {
+		errorDocument404 = "/" + errorDocument404
+	}
+	cacheMaxBytes := int64(0)
+	if n, err := strconv.ParseInt(os.Getenv("CACHE_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		cacheMaxBytes = n
+	}
+	// The default never conflicts with a smaller cache, only an explicit value does
+	cacheMaxObject := int64(1 << 20)
+	if n, err := strconv.ParseInt(os.Getenv("CACHE_MAX_OBJECT_BYTES"), 10, 64); err == nil && n > 0 {
+		cacheMaxObject = n
+	} else if cacheMaxBytes > 0 && cacheMaxObject > cacheMaxBytes {
+		cacheMaxObject = cacheMaxBytes
+	}
+	cacheTTL := time.Minute
+	if d, err := time.ParseDuration(os.Getenv("CACHE_TTL")); err == nil {
+		cacheTTL = d
+	}
+	staleRevalidate := time.Duration(0)
+	if n, err := strconv.Atoi(os.Getenv("STALE_WHILE_REVALIDATE")); err == nil && n > 0 {
+		staleRevalidate = time.Duration(n) * time.Second
+	}
+	diskCacheBytes := int64(1 << 30)
+	if n, err := strconv.ParseInt(os.Getenv("DISK_CACHE_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		diskCacheBytes = n
+	}
+	rangeCacheBytes := int64(0)
+	if n, err := strconv.ParseInt(os.Getenv("RANGE_CACHE_BYTES"), 10, 64); err == nil && n > 0 {
+		rangeCacheBytes = n
+	}
+	rangeCacheMax := int64(64 << 20)
+	if n, err := strconv.ParseInt(os.Getenv("RANGE_CACHE_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		rangeCacheMax = n
+	}
+	parallelParts := 0
+	if n, err := strconv.Atoi(os.Getenv("PARALLEL_DOWNLOAD_PARTS")); err == nil && n > 1 {
+		parallelParts = n
+	}
+	parallelPartSize := int64(8 << 20)
+	if n, err := strconv.ParseInt(os.Getenv("PARALLEL_DOWNLOAD_PART_BYTES"), 10, 64); err == nil && n > 0 {
+		parallelPartSize = n
+	}
+	parallelMinSize := int64(64 << 20)
+	if n, err := strconv.ParseInt(os.Getenv("PARALLEL_DOWNLOAD_THRESHOLD"), 10, 64); err == nil && n > 0 {
+		parallelMinSize = n
+	}
+	spaMode := false
+	if b, err := strconv.ParseBool(os.Getenv("SPA_MODE")); err == nil {
+		spaMode = b
+	}
+	corsAllowOrigin := []string{}
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOW_ORIGIN"), ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			corsAllowOrigin = append(corsAllowOrigin, origin)
+		}
+	}
+	corsAllowMethods := os.Getenv("CORS_ALLOW_METHODS")
+	if len(corsAllowMethods) == 0 {
+		corsAllowMethods = "GET, HEAD"
+	}
+	tlsMinVersion := uint16(tls.VersionTLS12)
+	if v := os.Getenv("TLS_MIN_VERSION"); len(v) > 0 {
+		parsed, err := parseTLSVersion(v)
+		if err != nil {
+			log.Fatalf("[config] %v", err)
+		}
+		tlsMinVersion = parsed
+	}
+	tlsCipherSuites, err := parseCipherSuites(os.Getenv("TLS_CIPHER_SUITES"))
+	if err != nil {
+		log.Fatalf("[config] %v", err)
+	}
+	symlinkMaxDepth := 5
+	if n, err := strconv.Atoi(os.Getenv("SYMLINK_MAX_DEPTH")); err == nil && n > 0 {
+		symlinkMaxDepth = n
+	}
+	symlinkPrefixes := []string{}
+	for _, prefix := range strings.Split(os.Getenv("SYMLINK_ALLOW_PREFIXES"), ",") {
+		if prefix = strings.TrimSpace(prefix); len(prefix) > 0 {
+			if !strings.HasPrefix(prefix, "/") {
+				prefix = "/" + prefix
+			}
+			symlinkPrefixes = append(symlinkPrefixes, prefix)
+		}
+	}
+	shutdownTimeout := 30 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil {
+		shutdownTimeout = d
+	}
+	acmeDomains := []string{}
+	for _, domain := range strings.Split(os.Getenv("ACME_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); len(domain) > 0 {
+			acmeDomains = append(acmeDomains, domain)
+		}
+	}
+	// TLS listens on 443 by default, leaving port 80 to the redirector
+	// that answers the ACME challenges
+	port := os.Getenv("APP_PORT")
+	if len(port) == 0 {
+		port = "80"
+		if len(acmeDomains) > 0 || (len(os.Getenv("SSL_CERT_PATH")) > 0 && len(os.Getenv("SSL_KEY_PATH")) > 0) {
+			port = "443"
+		}
+	}
+	httpRedirectPort := os.Getenv("HTTP_REDIRECT_PORT")
+	if len(httpRedirectPort) == 0 && len(acmeDomains) > 0 {
+		httpRedirectPort = "80"
+	}
+	enableH2C := false
+	if b, err := strconv.ParseBool(os.Getenv("ENABLE_H2C")); err == nil {
+		enableH2C = b
+	}
+	headerTimeout := 10 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("READ_HEADER_TIMEOUT")); err == nil {
+		headerTimeout = d
+	}
+	readTimeout := 30 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("READ_TIMEOUT")); err == nil {
+		readTimeout = d
+	}
+	writeTimeout := time.Duration(0)
+	if d, err := time.ParseDuration(os.Getenv("WRITE_TIMEOUT")); err == nil {
+		writeTimeout = d
+	}
+	idleTimeout := 2 * time.Minute
+	if d, err := time.ParseDuration(os.Getenv("IDLE_TIMEOUT")); err == nil {
+		idleTimeout = d
+	}
+	bucketMap := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("BUCKET_MAP"), ",") {
+		if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && len(kv[0]) > 0 && len(kv[1]) > 0 {
+			bucketMap[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+	ipAllow, err := parseCIDRs(os.Getenv("IP_ALLOW_CIDRS"))
+	if err != nil {
+		log.Fatalf("[config] IP_ALLOW_CIDRS: %v", err)
+	}
+	ipDeny, err := parseCIDRs(os.Getenv("IP_DENY_CIDRS"))
+	if err != nil {
+		log.Fatalf("[config] IP_DENY_CIDRS: %v", err)
+	}
+	trustedProxies, err := parseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("[config] TRUSTED_PROXIES: %v", err)
+	}
+	clientIPHeaders := []string{}
+	for _, name := range strings.Split(os.Getenv("CLIENT_IP_HEADERS"), ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			clientIPHeaders = append(clientIPHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+	if len(clientIPHeaders) == 0 {
+		clientIPHeaders = []string{"X-Forwarded-For", "Forwarded"}
+	}
+	presignExpiry := 15 * time.Minute
+	if d, err := time.ParseDuration(os.Getenv("PRESIGN_EXPIRY")); err == nil && d > 0 {
+		presignExpiry = d
+	}
+	canaryPercent := 0
+	if value := os.Getenv("CANARY_PERCENT"); len(value) > 0 {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 100 {
+			log.Fatalf("[config] CANARY_PERCENT must be 0 to 100, not %q", value)
+		}
+		canaryPercent = n
+	}
+	sseCustomerKey := ""
+	if encoded := os.Getenv("SSE_C_KEY"); len(encoded) > 0 {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			log.Fatal("[config] SSE_C_KEY must be a base64 encoded 256-bit key")
+		}
+		sseCustomerKey = string(key)
+	}
+	redirectBytes := int64(0)
+	if n, err := strconv.ParseInt(os.Getenv("REDIRECT_THRESHOLD_BYTES"), 10, 64); err == nil && n > 0 {
+		redirectBytes = n
+	}
+	maxObjectBytes := int64(0)
+	if n, err := strconv.ParseInt(os.Getenv("MAX_OBJECT_BYTES"), 10, 64); err == nil && n > 0 {
+		maxObjectBytes = n
+	}
+	oversizeRedirect := false
+	if b, err := strconv.ParseBool(os.Getenv("MAX_OBJECT_REDIRECT")); err == nil {
+		oversizeRedirect = b
+	}
+	customHeaders := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("CUSTOM_HEADERS"), "|") {
+		if kv := strings.SplitN(pair, ":", 2); len(kv) == 2 && len(strings.TrimSpace(kv[0])) > 0 {
+			customHeaders[http.CanonicalHeaderKey(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	metadataHeaders := []string{}
+	for _, name := range strings.Split(os.Getenv("EXPOSE_METADATA_HEADERS"), ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			metadataHeaders = append(metadataHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+	// An empty prefix stands for the bucket root, so it's kept
+	s3KeyPrefixes := strings.Split(os.Getenv("AWS_S3_KEY_PREFIX"), ",")
+	for i, prefix := range s3KeyPrefixes {
+		s3KeyPrefixes[i] = strings.TrimSpace(prefix)
+	}
+	serverHeader := os.Getenv("SERVER_HEADER")
+	if strings.EqualFold(serverHeader, "none") {
+		serverHeader = ""
+	}
+	debugHeaders := false
+	if b, err := strconv.ParseBool(os.Getenv("DEBUG_HEADERS")); err == nil {
+		debugHeaders = b
+	}
+	urlPrefixStrip := os.Getenv("URL_PREFIX_STRIP")
+	if len(urlPrefixStrip) > 0 {
+		urlPrefixStrip = "/" + strings.Trim(urlPrefixStrip, "/")
+	}
+	cacheControls := []cacheRule{}
+	for _, rule := range strings.Split(os.Getenv("CACHE_CONTROL_RULES"), "|") {
+		if kv := strings.SplitN(strings.TrimSpace(rule), "=", 2); len(kv) == 2 && len(kv[0]) > 0 {
+			cacheControls = append(cacheControls, cacheRule{pattern: kv[0], value: strings.TrimSpace(kv[1])})
+		}
+	}
+	immutablePaths := []string{}
+	for _, pattern := range strings.Split(os.Getenv("IMMUTABLE_PATHS"), ",") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) > 0 {
+			immutablePaths = append(immutablePaths, pattern)
+		}
+	}
+	pathRoutes := parsePathRoutes(os.Getenv("PATH_ROUTES"))
+	rewriteRules, err := parseRewriteRules(os.Getenv("REWRITE_RULES"))
+	if err != nil {
+		log.Fatalf("[config] REWRITE_RULES: %v", err)
+	}
+	basicAuthUsers := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("BASIC_AUTH_USERS"), ",") {
+		if kv := strings.SplitN(strings.TrimSpace(pair), ":", 2); len(kv) == 2 && len(kv[0]) > 0 && len(kv[1]) > 0 {
+			basicAuthUsers[kv[0]] = kv[1]
+		}
+	}
 	conf := &config{
 		awsRegion:        region,
+		roleARN:          os.Getenv("AWS_ROLE_ARN"),
+		roleSessionName:  os.Getenv("AWS_ROLE_SESSION_NAME"),
 		s3Bucket:         os.Getenv("AWS_S3_BUCKET"),
-		s3KeyPrefix:      os.Getenv("AWS_S3_KEY_PREFIX"),
+		bucketMap:        bucketMap,
+		s3Endpoint:       os.Getenv("S3_ENDPOINT"),
+		s3Accelerate:     s3Accelerate,
+		s3KeyPrefixes:    s3KeyPrefixes,
+		sseCustomerKey:   sseCustomerKey,
+		canaryPrefix:     os.Getenv("CANARY_PREFIX"),
+		canaryPercent:    canaryPercent,
+		urlPrefixStrip:   urlPrefixStrip,
+		keyTemplate:      os.Getenv("KEY_TEMPLATE"),
+		pathRoutes:       pathRoutes,
+		rewriteRules:     rewriteRules,
+		s3Timeout:        s3Timeout,
+		s3MaxRetries:     s3MaxRetries,
+		debugS3:          debugS3,
+		maxConcurrent:    maxConcurrent,
+		concurrencyWait:  concurrencyWait,
+		copyBufferBytes:  copyBufferBytes,
+		indexDocument:    indexDocument,
+		disableIndex:     disableIndex,
+		directoryListing: directoryListing,
+		rootObject:       rootObject,
+		rootRedirect:     os.Getenv("ROOT_REDIRECT"),
+		rootStatus:       rootStatus,
+		rootMessage:      rootMessage,
+		allowVersions:    allowVersions,
+		directoryRedir:   directoryRedir,
+		spaMode:          spaMode,
+		symlinkMaxDepth:  symlinkMaxDepth,
+		symlinkPrefixes:  symlinkPrefixes,
+		errorDocument404: errorDocument404,
+		cacheMaxBytes:    cacheMaxBytes,
+		cacheMaxObject:   cacheMaxObject,
+		cacheTTL:         cacheTTL,
+		staleRevalidate:  staleRevalidate,
+		diskCacheDir:     os.Getenv("DISK_CACHE_DIR"),
+		diskCacheBytes:   diskCacheBytes,
+		rangeCacheBytes:  rangeCacheBytes,
+		rangeCacheMax:    rangeCacheMax,
+		parallelParts:    parallelParts,
+		parallelPartSize: parallelPartSize,
+		parallelMinSize:  parallelMinSize,
 		httpCacheControl: os.Getenv("HTTP_CACHE_CONTROL"),
+		cacheControls:    cacheControls,
+		immutablePaths:   immutablePaths,
 		httpExpires:      os.Getenv("HTTP_EXPIRES"),
+		syntheticETag:    syntheticETag,
 		basicAuthUser:    os.Getenv("BASIC_AUTH_USER"),
 		basicAuthPass:    os.Getenv("BASIC_AUTH_PASS"),
+		basicAuthUsers:   basicAuthUsers,
+		corsAllowOrigin:  corsAllowOrigin,
+		corsAllowMethods: corsAllowMethods,
+		corsAllowHeaders: os.Getenv("CORS_ALLOW_HEADERS"),
+		ipAllow:          ipAllow,
+		ipDeny:           ipDeny,
+		trustedProxies:   trustedProxies,
+		clientIPHeaders:  clientIPHeaders,
+		presignExpiry:    presignExpiry,
+		redirectBytes:    redirectBytes,
+		maxObjectBytes:   maxObjectBytes,
+		oversizeRedirect: oversizeRedirect,
+		customHeaders:    customHeaders,
+		redirectsFile:    os.Getenv("REDIRECTS_FILE"),
+		metadataHeaders:  metadataHeaders,
+		debugHeaders:     debugHeaders,
+		serverHeader:     serverHeader,
+		host:             os.Getenv("APP_HOST"),
+		canonicalHost:    os.Getenv("CANONICAL_HOST"),
 		port:             port,
 		accessLog:        accessLog,
+		slowRequest:      slowRequest,
+		accessLogFormat:  accessLogFormat,
+		accessLogFile:    os.Getenv("ACCESS_LOG_FILE"),
+		metricsEnabled:   metricsEnabled,
+		gzipEnabled:      gzipEnabled,
+		gzipMinBytes:     gzipMinBytes,
+		gzipLevel:        gzipLevel,
+		precompressed:    precompressed,
 		sslCert:          os.Getenv("SSL_CERT_PATH"),
 		sslKey:           os.Getenv("SSL_KEY_PATH"),
+		httpRedirectPort: httpRedirectPort,
+		acmeDomains:      acmeDomains,
+		acmeCacheDir:     os.Getenv("ACME_CACHE_DIR"),
+		enableH2C:        enableH2C,
+		tlsMinVersion:    tlsMinVersion,
+		tlsCipherSuites:  tlsCipherSuites,
+		shutdownTimeout:  shutdownTimeout,
+		headerTimeout:    headerTimeout,
+		readTimeout:      readTimeout,
+		writeTimeout:     writeTimeout,
+		idleTimeout:      idleTimeout,
+	}
+	if err := validateConfig(conf); err != nil {
+		log.Fatalf("[config] %v", err)
 	}
 	// Proxy
 	log.Printf("[config] Proxy to %v", conf.s3Bucket)
+	for host, bucket := range conf.bucketMap {
+		log.Printf("[config] Proxy %v to %v", host, bucket)
+	}
+	for _, route := range conf.pathRoutes {
+		log.Printf("[config] Proxy %v to %v/%v", route.pathPrefix, route.bucket, route.keyPrefix)
+	}
 	log.Printf("[config] AWS Region: %v", conf.awsRegion)
+	if len(conf.s3Endpoint) > 0 {
+		log.Printf("[config] S3 Endpoint: %v", conf.s3Endpoint)
+	}
+	if conf.s3Accelerate {
+		log.Print("[config] S3 Transfer Acceleration enabled.")
+	}
+	if len(conf.s3KeyPrefixes) > 1 {
+		log.Printf("[config] Key prefixes: %v", strings.Join(conf.s3KeyPrefixes, ", "))
+	}
+	if len(conf.roleARN) > 0 {
+		log.Printf("[config] Assume role: %v", conf.roleARN)
+	}
 
 	// TLS pem files
-	if (len(conf.sslCert) > 0) && (len(conf.sslKey) > 0) {
+	if len(conf.acmeDomains) > 0 {
+		log.Printf("[config] TLS enabled with ACME certificates for %s", strings.Join(conf.acmeDomains, ", "))
+	} else if (len(conf.sslCert) > 0) && (len(conf.sslKey) > 0) {
 		log.Print("[config] TLS enabled.")
 	}
+	// In-memory cache
+	if conf.cacheMaxBytes > 0 {
+		log.Printf("[config] Cache: %d bytes (objects up to %d bytes, TTL %v, stale for %v)",
+			conf.cacheMaxBytes, conf.cacheMaxObject, conf.cacheTTL, conf.staleRevalidate)
+	}
+	if len(conf.diskCacheDir) > 0 {
+		log.Printf("[config] Disk cache: %d bytes in %v", conf.diskCacheBytes, conf.diskCacheDir)
+	}
+	if conf.rangeCacheBytes > 0 {
+		log.Printf("[config] Range cache: first %d bytes of objects (up to %d bytes)",
+			conf.rangeCacheBytes, conf.rangeCacheMax)
+	}
+	// CORS
+	if len(conf.corsAllowOrigin) > 0 {
+		log.Printf("[config] CORS allowed origins: %s", strings.Join(conf.corsAllowOrigin, ","))
+	}
 	// Basic authentication
 	if (len(conf.basicAuthUser) > 0) && (len(conf.basicAuthPass) > 0) {
-		log.Printf("[config] Basic authentication: %s", conf.basicAuthUser)
+		conf.basicAuthUsers[conf.basicAuthUser] = conf.basicAuthPass
+	}
+	for user := range conf.basicAuthUsers {
+		log.Printf("[config] Basic authentication: %s", user)
+	}
+	if dump, err := json.Marshal(configJSON(conf)); err == nil {
+		log.Printf("[config] Effective configuration: %s", dump)
 	}
 	return conf
 }
 
-type custom struct {
-	http.ResponseWriter
-	status int
+// validateConfig reports settings which would otherwise be silently
+// ignored: half-configured pairs and options that can't be combined.
+func validateConfig(conf *config) error {
+	problems := []string{}
+	if (len(conf.sslCert) > 0) != (len(conf.sslKey) > 0) {
+		problems = append(problems, "SSL_CERT_PATH and SSL_KEY_PATH must be set together")
+	}
+	if len(conf.httpRedirectPort) > 0 && len(conf.sslCert) == 0 && len(conf.acmeDomains) == 0 {
+		problems = append(problems, "HTTP_REDIRECT_PORT requires SSL_CERT_PATH and SSL_KEY_PATH, or ACME_DOMAINS")
+	}
+	if len(conf.acmeDomains) > 0 && len(conf.sslCert) > 0 {
+		problems = append(problems, "ACME_DOMAINS supersedes SSL_CERT_PATH and SSL_KEY_PATH, unset one or the other")
+	}
+	if len(conf.httpRedirectPort) > 0 && conf.httpRedirectPort == conf.port {
+		problems = append(problems, "HTTP_REDIRECT_PORT must differ from APP_PORT (ACME_DOMAINS defaults them to 80 and 443)")
+	}
+	if (len(conf.basicAuthUser) > 0) != (len(conf.basicAuthPass) > 0) {
+		problems = append(problems, "BASIC_AUTH_USER and BASIC_AUTH_PASS must be set together")
+	}
+	if len(conf.roleSessionName) > 0 && len(conf.roleARN) == 0 {
+		problems = append(problems, "AWS_ROLE_SESSION_NAME requires AWS_ROLE_ARN")
+	}
+	if conf.s3Accelerate && len(conf.s3Endpoint) > 0 {
+		problems = append(problems, "S3_ACCELERATE can't be used with a custom S3_ENDPOINT")
+	}
+	if len(conf.rootRedirect) > 0 && conf.rootStatus > 0 {
+		problems = append(problems, "ROOT_REDIRECT and ROOT_STATUS can't be used together")
+	}
+	if len(conf.keyTemplate) > 0 {
+		if _, err := parseKeyTemplate(conf.keyTemplate); err != nil {
+			problems = append(problems, fmt.Sprintf("KEY_TEMPLATE: %v", err))
+		}
+	}
+	if conf.redirectBytes > 0 && len(conf.sseCustomerKey) > 0 {
+		problems = append(problems, "REDIRECT_THRESHOLD_BYTES can't be used with SSE_C_KEY, clients can't send the key")
+	}
+	if len(conf.diskCacheDir) > 0 && len(conf.sseCustomerKey) > 0 {
+		problems = append(problems, "DISK_CACHE_DIR can't be used with SSE_C_KEY, objects would be stored decrypted")
+	}
+	if conf.enableH2C && (len(conf.sslCert) > 0 || len(conf.acmeDomains) > 0) {
+		problems = append(problems, "ENABLE_H2C only applies without TLS, HTTP/2 is already enabled over TLS")
+	}
+	if conf.oversizeRedirect && conf.maxObjectBytes == 0 {
+		problems = append(problems, "MAX_OBJECT_REDIRECT requires MAX_OBJECT_BYTES")
+	}
+	if conf.oversizeRedirect && len(conf.sseCustomerKey) > 0 {
+		problems = append(problems, "MAX_OBJECT_REDIRECT can't be used with SSE_C_KEY, clients can't send the key")
+	}
+	if conf.canaryPercent > 0 && len(conf.canaryPrefix) == 0 {
+		problems = append(problems, "CANARY_PERCENT requires CANARY_PREFIX")
+	}
+	if len(conf.accessLogFile) > 0 && !conf.accessLog {
+		problems = append(problems, "ACCESS_LOG_FILE requires ACCESS_LOG=true")
+	}
+	if conf.cacheMaxBytes > 0 && conf.cacheMaxObject > conf.cacheMaxBytes {
+		problems = append(problems, "CACHE_MAX_OBJECT_BYTES can't exceed CACHE_MAX_BYTES")
+	}
+	if conf.rangeCacheBytes > conf.rangeCacheMax {
+		problems = append(problems, "RANGE_CACHE_BYTES can't exceed RANGE_CACHE_MAX_BYTES")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
 }
 
-func (r *custom) WriteHeader(status int) {
-	r.ResponseWriter.WriteHeader(status)
-	r.status = status
+// parseRewriteRules reads rules of the form "pattern replacement",
+// separated by semicolons. Rules are tried in order.
+func parseRewriteRules(rules string) ([]rewriteRule, error) {
+	rewrites := []rewriteRule{}
+	for _, rule := range strings.Split(rules, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%q isn't of the form \"pattern replacement\"", strings.TrimSpace(rule))
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, rewriteRule{source: fields[0], pattern: pattern, replacement: fields[1]})
+	}
+	return rewrites, nil
 }
 
-func wrapper(f func(w http.ResponseWriter, r *http.Request)) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if (len(c.basicAuthUser) > 0) && (len(c.basicAuthPass) > 0) && !auth(r) {
-			w.Header().Set("WWW-Authenticate", `Basic realm="REALM"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
+// parsePathRoutes reads rules of the form pathPrefix=bucket[:keyPrefix].
+// Longer prefixes are tried first; rules of equal length keep their order.
+func parsePathRoutes(rules string) []pathRoute {
+	routes := []pathRoute{}
+	for _, rule := range strings.Split(rules, ",") {
+		kv := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			continue
 		}
-		proc := time.Now()
-		addr := r.RemoteAddr
-		if ip, found := header(r, "X-Forwarded-For"); found {
-			addr = ip
+		route := pathRoute{pathPrefix: "/" + strings.Trim(kv[0], "/")}
+		target := strings.SplitN(kv[1], ":", 2)
+		route.bucket = target[0]
+		if len(target) == 2 {
+			route.keyPrefix = target[1]
 		}
-		writer := &custom{ResponseWriter: w, status: http.StatusOK}
-		f(writer, r)
+		routes = append(routes, route)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].pathPrefix) > len(routes[j].pathPrefix)
+	})
+	return routes
+}
 
-		if c.accessLog {
-			log.Printf("[%s] %.3f %d %s %s",
-				addr, time.Now().Sub(proc).Seconds(),
-				writer.status, r.Method, r.URL)
+// parseCIDRs reads a comma-separated list of CIDRs. Bare addresses
+// are treated as single-host networks.
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); len(cidr) == 0 {
+			continue
 		}
-	})
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
 }
 
-func auth(r *http.Request) bool {
-	if username, password, ok := r.BasicAuth(); ok {
-		return username == c.basicAuthUser &&
-			password == c.basicAuthPass
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
 	}
-	return false
+	return 0, fmt.Errorf("unknown TLS version: %s", version)
 }
 
-func header(r *http.Request, key string) (string, bool) {
-	if r.Header == nil {
-		return "", false
+// parseCipherSuites converts a comma-separated list of cipher suite
+// names into their IDs. An empty list leaves the Go defaults in place.
+func parseCipherSuites(names string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
 	}
-	if candidate := r.Header[key]; len(candidate) > 0 {
-		return candidate[0], true
+	suites := []uint16{}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown TLS cipher suite: %s", name)
+		}
+		suites = append(suites, id)
 	}
-	return "", false
+	if len(suites) == 0 {
+		return nil, nil
+	}
+	return suites, nil
 }
 
-func awss3(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	bytesRange := r.Header.Get("Range")
+// secretFields are config fields whose values never appear in logs.
+var secretFields = map[string]bool{
+	"basicAuthPass":  true,
+	"basicAuthUsers": true,
+	"sseCustomerKey": true,
+}
 
-	obj, err := s3get(c.s3Bucket, c.s3KeyPrefix+path, bytesRange)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// configJSON converts the config into a map keyed by field name for
+// logging, with the values of secret fields redacted.
+func configJSON(conf *config) map[string]interface{} {
+	v := reflect.ValueOf(conf).Elem()
+	out := map[string]interface{}{}
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if secretFields[name] {
+			out[name] = redactedValue(v.Field(i))
+		} else {
+			out[name] = configValue(v.Field(i))
+		}
 	}
+	return out
+}
 
-	if len(c.httpCacheControl) > 0 {
-		setStrHeader(w, "Cache-Control", &c.httpCacheControl)
-	} else {
-		setStrHeader(w, "Cache-Control", obj.CacheControl)
+// configValue rebuilds a config field from its kind, since the fields
+// are unexported and can't be passed through Interface().
+func configValue(v reflect.Value) interface{} {
+	switch v.Type() {
+	case reflect.TypeOf(time.Duration(0)):
+		return time.Duration(v.Int()).String()
+	case reflect.TypeOf(&net.IPNet{}):
+		if v.IsNil() {
+			return nil
+		}
+		ipnet := net.IPNet{IP: v.Elem().Field(0).Bytes(), Mask: v.Elem().Field(1).Bytes()}
+		return ipnet.String()
+	case reflect.TypeOf(rewriteRule{}):
+		return map[string]interface{}{
+			"pattern":     v.FieldByName("source").String(),
+			"replacement": v.FieldByName("replacement").String(),
+		}
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint()
+	case reflect.Slice:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = configValue(v.Index(i))
+		}
+		return out
+	case reflect.Map:
+		out := map[string]interface{}{}
+		for _, key := range v.MapKeys() {
+			out[fmt.Sprint(key)] = configValue(v.MapIndex(key))
+		}
+		return out
+	case reflect.Struct:
+		out := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			out[v.Type().Field(i).Name] = configValue(v.Field(i))
+		}
+		return out
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return configValue(v.Elem())
+	}
+	return fmt.Sprint(v)
+}
+
+// redactedValue hides a secret while still showing whether it is set.
+// Maps keep their keys, so user names remain visible.
+func redactedValue(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Map {
+		out := map[string]interface{}{}
+		for _, key := range v.MapKeys() {
+			out[fmt.Sprint(key)] = "[redacted]"
+		}
+		return out
+	}
+	if v.Len() == 0 {
+		return ""
+	}
+	return "[redacted]"
+}
+
+type custom struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *custom) WriteHeader(status int) {
+	if !r.wroteHeader {
+		// Headers set by the handler win over the configured ones
+		for key, value := range c.customHeaders {
+			if len(r.Header().Get(key)) == 0 {
+				r.Header().Set(key, value)
+			}
+		}
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+	r.status = status
+}
+
+func (r *custom) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+type accessLogEntry struct {
+	RemoteAddr string  `json:"remote_addr"`
+	DurationMS float64 `json:"duration_ms"`
+	Status     int     `json:"status"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Bytes      int64   `json:"bytes"`
+	RequestID  string  `json:"request_id"`
+}
+
+// Access logs are kept apart from application logs so that
+// they can be sent to their own file.
+var (
+	accessLogger = log.New(os.Stderr, "", log.LstdFlags)
+	jsonLogger   = log.New(os.Stderr, "", 0)
+)
+
+var (
+	accessLogMu   sync.Mutex
+	accessLogFile *os.File
+)
+
+// openAccessLog (re)opens the access log file. The loggers serialize
+// writes internally, so once they point at the new file nothing writes
+// to the old one and it can be closed.
+func openAccessLog(path string) error {
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	accessLogger.SetOutput(file)
+	jsonLogger.SetOutput(file)
+	if accessLogFile != nil {
+		accessLogFile.Close()
+	}
+	accessLogFile = file
+	return nil
+}
+
+// reopenOnSignal reopens the access log file each time a signal arrives,
+// until the channel is closed.
+func reopenOnSignal(sig <-chan os.Signal, path string) {
+	for range sig {
+		if err := openAccessLog(path); err != nil {
+			log.Printf("[service] reopen access log: %v", err)
+		}
+	}
+}
+
+func wrapper(f func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-Id")
+		if len(requestID) == 0 {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+		writer := &custom{ResponseWriter: w, status: http.StatusOK}
+
+		addr := clientAddr(r)
+		if !ipAllowed(parseIP(addr)) {
+			http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		// Browsers never send credentials with CORS preflight requests,
+		// so OPTIONS is answered before basic auth
+		handler := f
+		if r.Method == http.MethodOptions {
+			handler = options
+		} else if (len(c.basicAuthUsers) > 0) && !auth(r) {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="REALM"`)
+			http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		proc := time.Now()
+		handler(writer, r)
+		if !writer.wroteHeader {
+			writer.WriteHeader(http.StatusOK)
+		}
+
+		elapsed := time.Now().Sub(proc)
+		if c.metricsEnabled {
+			observe(writer.status, elapsed)
+		}
+		if c.slowRequest > 0 && elapsed > c.slowRequest {
+			log.Printf("[warn] slow request: [%s] %.3f %d %d %s %s %s",
+				addr, elapsed.Seconds(),
+				writer.status, writer.bytes, r.Method, r.URL, requestID)
+		}
+		if c.accessLog {
+			if c.accessLogFormat == "json" {
+				entry, _ := json.Marshal(accessLogEntry{
+					RemoteAddr: addr,
+					DurationMS: float64(elapsed) / float64(time.Millisecond),
+					Status:     writer.status,
+					Method:     r.Method,
+					Path:       r.URL.Path,
+					Bytes:      writer.bytes,
+					RequestID:  requestID,
+				})
+				jsonLogger.Print(string(entry))
+			} else {
+				accessLogger.Printf("[%s] %.3f %d %d %s %s %s",
+					addr, elapsed.Seconds(),
+					writer.status, writer.bytes, r.Method, r.URL, requestID)
+			}
+		}
+	})
+}
+
+// requestScheme returns the scheme the client used. X-Forwarded-Proto
+// is only honored when the direct peer is a trusted proxy.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if inNetworks(parseIP(r.RemoteAddr), c.trustedProxies) && r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// redirectToHTTPS sends the client to the same URL on the TLS listener.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if c.port != "443" {
+		host = net.JoinHostPort(host, c.port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	target := url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+}
+
+// healthz reports whether the bucket is reachable from this process.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	_, err := s3For(c.s3Bucket).HeadBucketWithContext(r.Context(), &s3.HeadBucketInput{
+		Bucket: aws.String(c.s3Bucket),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateAccess checks that every configured bucket can be reached and
+// listed, logging the outcome for each. It reports whether all succeeded.
+func validateAccess() bool {
+	buckets := []string{c.s3Bucket}
+	for _, bucket := range c.bucketMap {
+		buckets = append(buckets, bucket)
+	}
+	for _, route := range c.pathRoutes {
+		buckets = append(buckets, route.bucket)
+	}
+	ok := true
+	seen := map[string]bool{}
+	for _, bucket := range buckets {
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+
+		if err := validateBucket(bucket); err != nil {
+			log.Printf("[validate] %s: %v", bucket, err)
+			ok = false
+			continue
+		}
+		log.Printf("[validate] %s: OK", bucket)
+	}
+	return ok
+}
+
+// validateBucket checks that a bucket can be reached and listed, within
+// S3_TIMEOUT.
+func validateBucket(bucket string) error {
+	ctx := context.Background()
+	if c.s3Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.s3Timeout)
+		defer cancel()
+	}
+	_, err := s3For(bucket).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil && relocate(ctx, bucket, err) {
+		_, err = s3For(bucket).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(bucket),
+		})
+	}
+	if err == nil {
+		_, err = s3For(bucket).ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(bucket),
+			MaxKeys: aws.Int64(1),
+		})
+	}
+	return err
+}
+
+// parseIP extracts the client IP from a remote address or header value.
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(strings.Split(addr, ",")[0])
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// clientAddr returns the address of the client. Forwarding headers are
+// only honored when the direct peer is a trusted proxy, tried in the order
+// of CLIENT_IP_HEADERS. Hops are read from right to left so that the first
+// untrusted hop is taken as the client.
+func clientAddr(r *http.Request) string {
+	if !inNetworks(parseIP(r.RemoteAddr), c.trustedProxies) {
+		return r.RemoteAddr
+	}
+	for _, name := range c.clientIPHeaders {
+		if _, found := header(r, name); !found {
+			continue
+		}
+		var hops []string
+		if name == "Forwarded" {
+			hops = forwardedFor(r.Header[name])
+		} else {
+			hops = strings.Split(strings.Join(r.Header[name], ","), ",")
+		}
+		if len(hops) == 0 {
+			continue
+		}
+		for i := len(hops) - 1; i > 0; i-- {
+			if hop := strings.TrimSpace(hops[i]); !inNetworks(parseIP(hop), c.trustedProxies) {
+				return hop
+			}
+		}
+		return strings.TrimSpace(hops[0])
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor extracts the for= addresses of an RFC 7239 Forwarded
+// header, such as for=192.0.2.60;proto=https, for="[2001:db8::1]:4711".
+func forwardedFor(values []string) []string {
+	hops := []string{}
+	for _, element := range strings.Split(strings.Join(values, ","), ",") {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				hops = append(hops, strings.Trim(kv[1], `"`))
+			}
+		}
+	}
+	return hops
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed applies the deny list first, then the allow list if one is set.
+func ipAllowed(ip net.IP) bool {
+	if len(c.ipAllow) == 0 && len(c.ipDeny) == 0 {
+		return true
+	}
+	if ip == nil || inNetworks(ip, c.ipDeny) {
+		return false
+	}
+	return len(c.ipAllow) == 0 || inNetworks(ip, c.ipAllow)
+}
+
+// newRequestID returns a random identifier for correlating logs.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func auth(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Check every pair so that the time taken doesn't reveal which user matched
+	matched := 0
+	for user, pass := range c.basicAuthUsers {
+		matched |= secureCompare(username, user) & secureCompare(password, pass)
+	}
+	return matched == 1
+}
+
+// secureCompare returns 1 if the two strings are equal, 0 otherwise.
+// Digests are compared instead of the raw values so that the length of
+// the expected value doesn't leak through timing either.
+func secureCompare(given, expected string) int {
+	g := sha256.Sum256([]byte(given))
+	e := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(g[:], e[:])
+}
+
+func header(r *http.Request, key string) (string, bool) {
+	if r.Header == nil {
+		return "", false
+	}
+	if candidate := r.Header[key]; len(candidate) > 0 {
+		return candidate[0], true
+	}
+	return "", false
+}
+
+// allowedMethods are the methods the proxy answers.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+func awss3(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	// Only reads are proxied; request bodies are never read
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(c.canonicalHost) > 0 && !strings.EqualFold(r.Host, c.canonicalHost) {
+		target := url.URL{
+			Scheme:   requestScheme(r),
+			Host:     c.canonicalHost,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return
+	}
+	if to, status, found := findRedirect(r.URL.Path); found {
+		if len(r.URL.RawQuery) > 0 && !strings.Contains(to, "?") {
+			to += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, to, status)
+		return
+	}
+	// The deadline only covers waiting for S3, not streaming the body
+	ctx, stop, cancel := withS3Timeout(r.Context())
+	defer cancel()
+
+	path, valid := requestPath(r)
+	if !valid {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if len(c.urlPrefixStrip) > 0 {
+		stripped, matched := stripPathPrefix(path, c.urlPrefixStrip)
+		if !matched {
+			http.NotFound(w, r)
+			return
+		}
+		path = stripped
+	}
+	path = rewrite(path)
+	if len(c.canaryPrefix) > 0 {
+		setCanaryCookie(w, r)
+	}
+	bucket, keyPrefixes, path := route(r, path)
+	keyPrefix := keyPrefixes[0]
+
+	// Limit the number of requests in flight to S3, from resolving
+	// symlinks to streaming the body
+	if slots != nil {
+		timer := time.NewTimer(c.concurrencyWait)
+		select {
+		case slots <- struct{}{}:
+			timer.Stop()
+			defer func() { <-slots }()
+		case <-timer.C:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	path, err := resolveSymlinks(ctx, bucket, keyPrefix, path)
+	if err == errSymlinkLoop {
+		http.Error(w, err.Error(), http.StatusLoopDetected)
+		return
+	}
+	if err == errSymlinkForbidden {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		code, message := toHTTPError(err)
+		http.Error(w, message, code)
+		return
+	}
+	dir := ""
+	if strings.HasSuffix(path, "/") {
+		dir = path
+		if r.URL.Path == "/" && len(c.rootObject) > 0 {
+			path = c.rootObject
+		} else if !c.disableIndex {
+			path += c.indexDocument
+		}
+	}
+	if keyTemplate != nil {
+		if path, err = applyKeyTemplate(r, path); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Immutable assets never change, so a known ETag needs no revalidation
+	immutable := etags != nil && isImmutable(path)
+	if immutable {
+		if etag, found := etags.get(bucket + "/" + keyPrefix + path); found && etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// Large objects are downloaded straight from S3 to save egress
+	if c.redirectBytes > 0 && r.Method == http.MethodGet {
+		versionID := ""
+		if c.allowVersions {
+			versionID = r.URL.Query().Get("versionId")
+		}
+		if head, err := s3head(ctx, bucket, keyPrefix+path, versionID); err == nil && aws.Int64Value(head.ContentLength) > c.redirectBytes {
+			if url, err := presignURL(bucket, keyPrefix+path, versionID, c.presignExpiry); err == nil {
+				http.Redirect(w, r, url, http.StatusFound)
+				return
+			}
+		}
+	}
+
+	key := keyPrefix + path
+	obj, err := fetch(ctx, r, bucket, key)
+	for _, prefix := range keyPrefixes[1:] {
+		if err == nil || !isNoSuchKey(err) {
+			break
+		}
+		key = prefix + path
+		obj, err = fetch(ctx, r, bucket, key)
+	}
+
+	if err != nil && c.directoryListing && isNoSuchKey(err) && len(dir) > 0 &&
+		listDirectory(ctx, w, r, bucket, keyPrefix+dir) {
+		return
+	}
+	if err != nil && c.directoryRedir && isNoSuchKey(err) && len(dir) == 0 &&
+		isDirectory(ctx, bucket, keyPrefix+path+"/") {
+		target := url.URL{Path: r.URL.Path + "/", RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return
+	}
+
+	// Let the single-page app handle client-side routes which don't exist
+	// in the bucket. Requests for files (with an extension) still 404.
+	if err != nil && c.spaMode && isNoSuchKey(err) && !strings.Contains(pathpkg.Base(r.URL.Path), ".") {
+		key = keyPrefix + "/" + c.indexDocument
+		obj, err = fetch(ctx, r, bucket, key)
+	}
+	if c.debugHeaders {
+		w.Header().Set("X-Debug-S3-Bucket", bucket)
+		w.Header().Set("X-Debug-S3-Key", key)
+	}
+	if isNotModified(err) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err != nil {
+		if ctx.Err() != nil && r.Context().Err() == nil {
+			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			return
+		}
+		// S3 doesn't say how large the object is, so ask before answering
+		if isInvalidRange(err) {
+			versionID := ""
+			if c.allowVersions {
+				versionID = r.URL.Query().Get("versionId")
+			}
+			if head, err := s3head(ctx, bucket, key, versionID); err == nil && head.ContentLength != nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", *head.ContentLength))
+			}
+			http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		// The landing page is up to the operator when / has nothing to serve
+		if r.URL.Path == "/" && isNoSuchKey(err) {
+			if len(c.rootRedirect) > 0 {
+				http.Redirect(w, r, c.rootRedirect, http.StatusFound)
+				return
+			}
+			if c.rootStatus > 0 {
+				http.Error(w, c.rootMessage, c.rootStatus)
+				return
+			}
+		}
+		if len(c.errorDocument404) > 0 && isNoSuchKey(err) &&
+			errorDocument(ctx, w, r, bucket, keyPrefix+c.errorDocument404, http.StatusNotFound) {
+			return
+		}
+		code, message := toHTTPError(err)
+		http.Error(w, message, code)
+		return
+	}
+	// The response arrived, but maybe too late to read its body
+	if !stop() {
+		if obj.Body != nil {
+			obj.Body.Close()
+		}
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return
+	}
+
+	// Synthetic ETags are unknown to S3, so If-None-Match is evaluated here
+	if c.syntheticETag {
+		obj.ETag = syntheticETag(obj)
+		if etagMatches(r.Header.Get("If-None-Match"), aws.StringValue(obj.ETag)) {
+			if obj.Body != nil {
+				obj.Body.Close()
+			}
+			setStrHeader(w, "ETag", obj.ETag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// Refuse to stream responses over the size limit
+	if c.maxObjectBytes > 0 && aws.Int64Value(obj.ContentLength) > c.maxObjectBytes {
+		if obj.Body != nil {
+			obj.Body.Close()
+		}
+		if c.oversizeRedirect {
+			versionID := ""
+			if c.allowVersions {
+				versionID = r.URL.Query().Get("versionId")
+			}
+			if url, err := presignURL(bucket, key, versionID, c.presignExpiry); err == nil {
+				http.Redirect(w, r, url, http.StatusFound)
+				return
+			}
+		}
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Objects uploaded without metadata have no meaningful type
+	if contentType := aws.StringValue(obj.ContentType); len(contentType) == 0 || contentType == "application/octet-stream" {
+		if guessed := mime.TypeByExtension(pathpkg.Ext(path)); len(guessed) > 0 {
+			obj.ContentType = aws.String(guessed)
+		}
+	}
+
+	if value, found := cacheControlFor(path); found {
+		setStrHeader(w, "Cache-Control", &value)
+	} else if len(c.httpCacheControl) > 0 {
+		setStrHeader(w, "Cache-Control", &c.httpCacheControl)
+	} else {
+		setStrHeader(w, "Cache-Control", obj.CacheControl)
 	}
 
 	if len(c.httpExpires) > 0 {
@@ -184,35 +1838,754 @@ func awss3(w http.ResponseWriter, r *http.Request) {
 		setStrHeader(w, "Expires", obj.Expires)
 	}
 
-	setStrHeader(w, "Accept-Ranges", obj.AcceptRanges)
+	// Objects stored gzipped are inflated for clients that can't decode
+	// them. A partial body can't be inflated, so ranges are sent as is.
+	storedGzip := strings.EqualFold(aws.StringValue(obj.ContentEncoding), "gzip")
+	inflate := storedGzip && !acceptsEncoding(r, "gzip") && len(aws.StringValue(obj.ContentRange)) == 0
+	var body io.Reader = obj.Body
+	if inflate && obj.Body != nil {
+		gr, err := gzip.NewReader(obj.Body)
+		if err != nil {
+			obj.Body.Close()
+			http.Error(w, "invalid gzip encoded object", http.StatusBadGateway)
+			return
+		}
+		body = gr
+	}
+
+	// Tell caches when the response depends on Accept-Encoding
+	if c.precompressed || storedGzip || (c.gzipEnabled && compressible(obj)) {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	// Content-Length must match the bytes actually written: S3 reports the
+	// partial length for ranged responses, and the compressed length isn't
+	// known until the body has been written, so it's omitted for gzip.
+	// Empty objects get an explicit zero; only a nil length is unknown.
+	gzipped := c.gzipEnabled && compressible(obj) && acceptsEncoding(r, "gzip")
+	w.Header().Del("Content-Length")
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+	} else if !inflate {
+		setStrHeader(w, "Content-Encoding", obj.ContentEncoding)
+		setIntHeader(w, "Content-Length", obj.ContentLength)
+	}
+
+	if !inflate {
+		setStrHeader(w, "Accept-Ranges", obj.AcceptRanges)
+	}
 	setStrHeader(w, "Content-Disposition", obj.ContentDisposition)
-	setStrHeader(w, "Content-Encoding", obj.ContentEncoding)
 	setStrHeader(w, "Content-Language", obj.ContentLanguage)
-	setIntHeader(w, "Content-Length", obj.ContentLength)
 	setStrHeader(w, "Content-Range", obj.ContentRange)
 	setStrHeader(w, "Content-Type", obj.ContentType)
 	setStrHeader(w, "ETag", obj.ETag)
 	setTimeHeader(w, "Last-Modified", obj.LastModified)
+	if immutable && obj.ETag != nil {
+		etags.add(bucket+"/"+keyPrefix+path, *obj.ETag)
+	}
+
+	// Only the metadata keys listed in EXPOSE_METADATA_HEADERS are surfaced
+	for _, name := range c.metadataHeaders {
+		for key, value := range obj.Metadata {
+			if strings.EqualFold(key, name) {
+				setStrHeader(w, "X-Amz-Meta-"+name, value)
+			}
+		}
+	}
 
-	if len(bytesRange) > 0 {
+	// S3 ignores ranges it can't parse and returns the whole object,
+	// so only respond with 206 when it actually sent a partial body.
+	if obj.ContentRange != nil && len(*obj.ContentRange) > 0 {
 		w.WriteHeader(http.StatusPartialContent)
 	}
 
-	io.Copy(w, obj.Body)
+	if obj.Body != nil {
+		defer obj.Body.Close()
+		if gzipped {
+			gz, _ := gzip.NewWriterLevel(w, c.gzipLevel)
+			copyBody(gz, body)
+			gz.Close()
+		} else {
+			copyBody(w, body)
+		}
+	}
 }
 
-func s3get(backet, key string, bytesRange string) (*s3.GetObjectOutput, error) {
-	sess := session.New(aws.NewConfig().WithRegion(c.awsRegion))
+// withS3Timeout derives a context that is cancelled once S3_TIMEOUT has
+// passed, unless stop is called first. stop reports whether it was in
+// time. Unlike a deadline, this leaves the body free to stream for as
+// long as the client takes once S3 has responded.
+func withS3Timeout(parent context.Context) (context.Context, func() bool, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if c.s3Timeout <= 0 {
+		return ctx, func() bool { return true }, cancel
+	}
+	timer := time.AfterFunc(c.s3Timeout, cancel)
+	return ctx, timer.Stop, cancel
+}
+
+// options answers OPTIONS, including CORS preflight requests, without
+// hitting S3. OPTIONS * never gets here, net/http answers it itself.
+func options(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	w.Header().Set("Allow", allowedMethods)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setCORSHeaders allows the request's origin if CORS_ALLOW_ORIGIN lists it.
+// Preflight requests are also told the allowed methods and headers.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	if len(c.corsAllowOrigin) == 0 {
+		return
+	}
+	origin, allowed := corsOrigin(r)
+	if !allowed {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if origin != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+	if r.Method == http.MethodOptions {
+		setStrHeader(w, "Access-Control-Allow-Methods", &c.corsAllowMethods)
+		setStrHeader(w, "Access-Control-Allow-Headers", &c.corsAllowHeaders)
+	}
+}
+
+// rewrite applies the first REWRITE_RULES rule matching the path.
+// Unlike a redirect, the client never sees the rewritten path.
+func rewrite(path string) string {
+	for _, rule := range c.rewriteRules {
+		if rule.pattern.MatchString(path) {
+			return rule.pattern.ReplaceAllString(path, rule.replacement)
+		}
+	}
+	return path
+}
+
+// route resolves the bucket, key prefixes and remaining path for a request.
+// Path routes take precedence over the host based bucket map. There is
+// always at least one key prefix; the first is the primary one.
+func route(r *http.Request, path string) (string, []string, string) {
+	for _, route := range c.pathRoutes {
+		if stripped, matched := stripPathPrefix(path, route.pathPrefix); matched {
+			return route.bucket, []string{route.keyPrefix}, stripped
+		}
+	}
+	if len(c.canaryPrefix) > 0 && inCanary(r) {
+		return bucketFor(r), []string{c.canaryPrefix}, path
+	}
+	return bucketFor(r), c.s3KeyPrefixes, path
+}
+
+// canaryCookie keeps a client on the same side of the canary split.
+const canaryCookie = "canary"
+
+// inCanary decides whether the request is served from CANARY_PREFIX.
+// The canary cookie wins; otherwise the client IP is hashed, so that
+// the same client always gets the same answer.
+func inCanary(r *http.Request) bool {
+	if cookie, err := r.Cookie(canaryCookie); err == nil && (cookie.Value == "1" || cookie.Value == "0") {
+		return cookie.Value == "1"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(parseIP(clientAddr(r)).String()))
+	return int(h.Sum32()%100) < c.canaryPercent
+}
+
+// setCanaryCookie pins the client to its side of the canary split.
+func setCanaryCookie(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(canaryCookie); err == nil {
+		return
+	}
+	value := "0"
+	if inCanary(r) {
+		value = "1"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     canaryCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   30 * 24 * 60 * 60,
+		HttpOnly: true,
+	})
+}
+
+// requestPath decodes the escaped request path into the form used for
+// S3 keys, so that my%20file.pdf maps to the key "my file.pdf". A + is
+// kept as is: only query strings use it for spaces, and keys may contain
+// a literal plus sign. The query string never takes part in the key, so
+// cache busting parameters such as ?v=1a2b don't change the object that
+// is fetched. It reports false for undecodable or unsafe paths.
+func requestPath(r *http.Request) (string, bool) {
+	decoded, err := url.PathUnescape(r.URL.EscapedPath())
+	if err != nil {
+		return "", false
+	}
+	return cleanPath(decoded)
+}
+
+// cleanPath collapses dot segments and repeated slashes, keeping a
+// trailing slash. It reports false when the path climbs above its root,
+// which would otherwise let the key escape the configured key prefix.
+func cleanPath(p string) (string, bool) {
+	cleaned := pathpkg.Clean(strings.TrimLeft(p, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	if cleaned == "." {
+		return "/", true
+	}
+	if strings.HasSuffix(p, "/") {
+		return "/" + cleaned + "/", true
+	}
+	return "/" + cleaned, true
+}
+
+// stripPathPrefix removes a leading path segment prefix such as /downloads,
+// reporting whether the path was under that prefix at all.
+func stripPathPrefix(path, prefix string) (string, bool) {
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return path, false
+	}
+	return "/" + strings.TrimPrefix(path[len(prefix):], "/"), true
+}
+
+// resolveSymlinks follows chained symlink.json objects in the path.
+// It gives up once a symlink is visited twice or the chain gets too deep.
+func resolveSymlinks(ctx context.Context, bucket, keyPrefix, path string) (string, error) {
+	visited := map[string]bool{}
+	for {
+		idx := strings.Index(path, symlinkName)
+		if idx < 0 {
+			return path, nil
+		}
+		link := path[:idx+len(symlinkName)]
+		if visited[link] || len(visited) >= c.symlinkMaxDepth {
+			return "", errSymlinkLoop
+		}
+		visited[link] = true
+
+		obj, err := s3get(ctx, bucket, keyPrefix+link, "", nil)
+		if err != nil {
+			return "", err
+		}
+		symlink := &Symlink{}
+		err = json.NewDecoder(obj.Body).Decode(symlink)
+		obj.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(symlink.URL, "/") {
+			symlink.URL = "/" + symlink.URL
+		}
+		if !symlinkAllowed(symlink.URL) {
+			return "", errSymlinkForbidden
+		}
+		path = strings.TrimSuffix(symlink.URL, "/") + path[idx+len(symlinkName):]
+		if len(path) == 0 {
+			path = "/"
+		}
+	}
+}
+
+// symlinkAllowed reports whether a symlink may point to the target.
+// Every target is allowed unless SYMLINK_ALLOW_PREFIXES is set.
+func symlinkAllowed(target string) bool {
+	if len(c.symlinkPrefixes) == 0 {
+		return true
+	}
+	target = pathpkg.Clean(target)
+	for _, prefix := range c.symlinkPrefixes {
+		if strings.HasPrefix(target, prefix) || target+"/" == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketFor picks the bucket to serve the request from based on its Host.
+func bucketFor(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if bucket, found := c.bucketMap[strings.ToLower(host)]; found {
+		return bucket
+	}
+	return c.s3Bucket
+}
+
+// errorDocument responds with the object stored at the given key
+// and status code. It returns false if the object couldn't be fetched.
+func errorDocument(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, key string, status int) bool {
+	obj, err := s3get(ctx, bucket, key, "", nil)
+	if err != nil {
+		return false
+	}
+	defer obj.Body.Close()
+
+	setStrHeader(w, "Content-Type", obj.ContentType)
+	setIntHeader(w, "Content-Length", obj.ContentLength)
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		copyBody(w, obj.Body)
+	}
+	return true
+}
+
+// wantsJSON reports whether the client asked for a machine-readable response.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// isDirectory reports whether any object exists under the prefix.
+func isDirectory(ctx context.Context, bucket, prefix string) bool {
+	out, err := s3For(bucket).ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(strings.TrimPrefix(prefix, "/")),
+		MaxKeys: aws.Int64(1),
+	})
+	return err == nil && len(out.Contents) > 0
+}
+
+// cacheControlFor returns the value of the first Cache-Control rule matching the path.
+// Patterns without a slash are matched against the file name only.
+func cacheControlFor(path string) (string, bool) {
+	for _, rule := range c.cacheControls {
+		if matchPath(rule.pattern, path) {
+			return rule.value, true
+		}
+	}
+	return "", false
+}
+
+// isImmutable reports whether path matches one of IMMUTABLE_PATHS.
+func isImmutable(path string) bool {
+	for _, pattern := range c.immutablePaths {
+		if matchPath(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath matches a path against a glob such as /assets/*.js, a glob
+// for the last segment such as *.html, or an extension such as .css.
+func matchPath(pattern, path string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "."):
+		return pathpkg.Ext(path) == pattern
+	case strings.Contains(pattern, "/"):
+		matched, _ := pathpkg.Match(pattern, path)
+		return matched
+	default:
+		matched, _ := pathpkg.Match(pattern, pathpkg.Base(path))
+		return matched
+	}
+}
+
+// corsOrigin returns the value for Access-Control-Allow-Origin
+// and whether the request's origin is allowed at all.
+func corsOrigin(r *http.Request) (string, bool) {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return "", false
+	}
+	for _, allowed := range c.corsAllowOrigin {
+		if allowed == "*" {
+			return "*", true
+		}
+		if allowed == origin {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// precompressedVariants are tried in order of preference.
+var precompressedVariants = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// fetch retrieves the object, preferring a pre-compressed variant
+// when the client accepts it. Brotli is preferred over gzip.
+func fetch(ctx context.Context, r *http.Request, backet, key string) (*s3.GetObjectOutput, error) {
+	// A version ID only applies to the original object, never to its variants
+	versioned := c.allowVersions && len(r.URL.Query().Get("versionId")) > 0
+	for _, variant := range precompressedVariants {
+		if !c.precompressed || versioned || !acceptsEncoding(r, variant.encoding) {
+			continue
+		}
+		obj, err := fetchObject(ctx, r, backet, key+variant.extension)
+		if err == nil {
+			obj.ContentEncoding = aws.String(variant.encoding)
+			if contentType := mime.TypeByExtension(pathpkg.Ext(key)); len(contentType) > 0 {
+				obj.ContentType = aws.String(contentType)
+			}
+		}
+		// Without s3:ListBucket S3 denies access to missing keys instead
+		if !isNoSuchKey(err) && !isAccessDenied(err) {
+			return obj, err
+		}
+	}
+	return fetchObject(ctx, r, backet, key)
+}
+
+// fetchObject retrieves the object, or just its metadata for HEAD requests.
+func fetchObject(ctx context.Context, r *http.Request, backet, key string) (*s3.GetObjectOutput, error) {
+	versionID := ""
+	if c.allowVersions {
+		versionID = r.URL.Query().Get("versionId")
+	}
+	if r.Method == http.MethodHead {
+		return s3head(ctx, backet, key, versionID)
+	}
+	if ranges != nil && len(versionID) == 0 {
+		if start, end, ok := warmRange(r.Header); ok {
+			if obj, err := s3getWarmRange(ctx, backet, key, start, end); obj != nil || err != nil {
+				return obj, err
+			}
+		}
+	}
+	if objects != nil && cacheable(r.Header) && len(versionID) == 0 {
+		return s3getCached(ctx, backet, key)
+	}
+	if disk != nil && cacheable(r.Header) && len(versionID) == 0 {
+		return s3getDisk(ctx, backet, key)
+	}
+	if cacheable(r.Header) && len(versionID) == 0 {
+		return s3getFull(ctx, backet, key)
+	}
+	return s3get(ctx, backet, key, versionID, r.Header)
+}
+
+// cacheable reports whether a request can be answered from the object
+// cache. Ranged and conditional requests always go to S3.
+func cacheable(h http.Header) bool {
+	for _, key := range []string{"Range", "If-Modified-Since", "If-None-Match"} {
+		if len(h.Get(key)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// s3getCached serves small objects from memory, populating the cache on a
+// miss from the disk cache when there is one, or from S3.
+func s3getCached(ctx context.Context, backet, key string) (*s3.GetObjectOutput, error) {
+	if obj, found, stale := objects.get(backet + "/" + key); found {
+		if stale && objects.startRefresh(backet+"/"+key) {
+			go refreshCached(backet, key)
+		}
+		return obj, nil
+	}
+	var obj *s3.GetObjectOutput
+	var err error
+	if disk != nil {
+		obj, err = s3getDisk(ctx, backet, key)
+	} else {
+		obj, err = s3getFull(ctx, backet, key)
+	}
+	if err != nil || obj.ContentLength == nil || *obj.ContentLength > c.cacheMaxObject {
+		return obj, err
+	}
+	body, err := ioutil.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	objects.add(backet+"/"+key, obj, body)
+	obj.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return obj, nil
+}
+
+// refreshCached replaces a stale cache entry in the background. When S3
+// can't be reached the stale entry is kept, and served until it's too old.
+func refreshCached(backet, key string) {
+	cacheKey := backet + "/" + key
+	defer objects.endRefresh(cacheKey)
+
+	ctx := context.Background()
+	if c.s3Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.s3Timeout)
+		defer cancel()
+	}
+	obj, err := s3get(ctx, backet, key, "", nil)
+	if isNoSuchKey(err) {
+		objects.forget(cacheKey)
+		return
+	}
+	if err != nil {
+		log.Printf("[cache] refresh %s: %v", cacheKey, err)
+		return
+	}
+	defer obj.Body.Close()
+	if obj.ContentLength == nil || *obj.ContentLength > c.cacheMaxObject {
+		objects.forget(cacheKey)
+		return
+	}
+	body, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		log.Printf("[cache] refresh %s: %v", cacheKey, err)
+		return
+	}
+	objects.add(cacheKey, obj, body)
+}
+
+// isNoSuchKey reports whether err means the requested object doesn't exist.
+func isNoSuchKey(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
+
+// isAccessDenied reports whether S3 refused access to the object.
+func isAccessDenied(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "AccessDenied" || aerr.Code() == "Forbidden"
+	}
+	return false
+}
+
+// isNotModified reports whether S3 answered a conditional request with 304.
+func isNotModified(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "NotModified"
+	}
+	return false
+}
+
+// isInvalidRange reports whether S3 rejected the requested byte range.
+func isInvalidRange(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "InvalidRange"
+	}
+	return false
+}
+
+// toHTTPError maps an error returned from S3 to an HTTP status code
+// and a short message suitable for the response body.
+func toHTTPError(err error) (int, string) {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
+			return http.StatusNotFound, http.StatusText(http.StatusNotFound)
+		case "AccessDenied", "Forbidden":
+			return http.StatusForbidden, http.StatusText(http.StatusForbidden)
+		case "InvalidRange":
+			return http.StatusRequestedRangeNotSatisfiable, http.StatusText(http.StatusRequestedRangeNotSatisfiable)
+		}
+	}
+	return http.StatusInternalServerError, err.Error()
+}
+
+// newS3Client builds the S3 client shared by every request.
+func newS3Client(conf *config) (s3iface.S3API, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *aws.NewConfig().WithRegion(conf.awsRegion),
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Throttling and 5xx errors are retried with exponential backoff,
+	// giving up early once the request context is done
+	cfg := aws.NewConfig().WithMaxRetries(conf.s3MaxRetries)
+	if len(conf.s3Endpoint) > 0 {
+		cfg = cfg.WithEndpoint(conf.s3Endpoint).WithS3ForcePathStyle(true)
+	}
+	if conf.s3Accelerate {
+		cfg = cfg.WithS3UseAccelerate(true)
+	}
+	// Headers, retries and errors only: object bodies would flood the log
+	if conf.debugS3 {
+		cfg = cfg.WithLogLevel(aws.LogDebug | aws.LogDebugWithRequestRetries | aws.LogDebugWithRequestErrors).
+			WithLogger(aws.LoggerFunc(func(args ...interface{}) {
+				log.Println(append([]interface{}{"[s3]"}, args...)...)
+			}))
+	}
+	if len(conf.roleARN) > 0 {
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(sess, conf.roleARN, func(p *stscreds.AssumeRoleProvider) {
+			if len(conf.roleSessionName) > 0 {
+				p.RoleSessionName = conf.roleSessionName
+			}
+		}))
+	}
+	return s3.New(sess, cfg), nil
+}
+
+// s3get fetches an object, forwarding the range and conditional
+// headers of the client request. h may be nil.
+func s3get(ctx context.Context, backet, key, versionID string, h http.Header) (*s3.GetObjectOutput, error) {
 	req := &s3.GetObjectInput{
 		Bucket: aws.String(backet),
 		Key:    aws.String(key),
 	}
+	req.SSECustomerAlgorithm, req.SSECustomerKey, req.SSECustomerKeyMD5 = sseCustomer()
 
-	if len(bytesRange) > 0 {
+	if len(versionID) > 0 {
+		req.VersionId = aws.String(versionID)
+	}
+	if bytesRange := h.Get("Range"); strings.HasPrefix(bytesRange, "bytes=") {
 		req.Range = aws.String(bytesRange)
 	}
+	if since, err := http.ParseTime(h.Get("If-Modified-Since")); err == nil {
+		req.IfModifiedSince = aws.Time(since)
+	}
+	// ETags are passed through verbatim to keep their weak/strong form,
+	// S3 compares multipart ETags as the opaque strings they are
+	if etag := h.Get("If-None-Match"); len(etag) > 0 && !c.syntheticETag {
+		req.IfNoneMatch = aws.String(etag)
+	}
+
+	obj, err := s3For(backet).GetObjectWithContext(ctx, req)
+	if err != nil && relocate(ctx, backet, err) {
+		obj, err = s3For(backet).GetObjectWithContext(ctx, req)
+	}
+
+	// S3 doesn't support If-Range, so when the validator turns out to be
+	// stale the whole object is fetched instead of the requested range.
+	if err == nil && req.Range != nil && !ifRangeMatches(h.Get("If-Range"), obj) {
+		obj.Body.Close()
+		req.Range = nil
+		return s3For(backet).GetObjectWithContext(ctx, req)
+	}
+	return obj, err
+}
+
+// ifRangeMatches evaluates an If-Range validator, which is either
+// a strong ETag or an HTTP date, against the object.
+func ifRangeMatches(validator string, obj *s3.GetObjectOutput) bool {
+	if len(validator) == 0 {
+		return true
+	}
+	if strings.HasPrefix(validator, `"`) {
+		if c.syntheticETag {
+			return validator == aws.StringValue(syntheticETag(obj))
+		}
+		return validator == aws.StringValue(obj.ETag)
+	}
+	if strings.HasPrefix(validator, "W/") {
+		return false
+	}
+	date, err := http.ParseTime(validator)
+	return err == nil && obj.LastModified != nil && obj.LastModified.Truncate(time.Second).Equal(date)
+}
+
+// syntheticETag derives a stable ETag from the modification time and
+// complete size of an object, falling back to the native ETag when
+// either is missing.
+func syntheticETag(obj *s3.GetObjectOutput) *string {
+	size := objectSize(obj.ContentRange)
+	if size < 0 && obj.ContentLength != nil {
+		size = *obj.ContentLength
+	}
+	if obj.LastModified == nil || size < 0 {
+		return obj.ETag
+	}
+	return aws.String(fmt.Sprintf(`"%x-%x"`, obj.LastModified.Unix(), size))
+}
+
+// etagMatches reports whether an If-None-Match header lists etag,
+// using the weak comparison RFC 7232 requires for that header. ETags
+// are opaque: multipart ETags such as "abc-5" aren't MD5 digests, so
+// they are only ever compared as strings.
+func etagMatches(header, etag string) bool {
+	if len(header) == 0 || len(etag) == 0 {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range splitETags(header) {
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// splitETags splits a list of entity tags. Commas may appear inside the
+// quotes of an entity tag, so the list can't simply be split on them.
+func splitETags(header string) []string {
+	etags := []string{}
+	for {
+		header = strings.TrimLeft(header, " \t,")
+		if len(header) == 0 {
+			return etags
+		}
+		end := strings.IndexByte(header, ',')
+		if start := strings.IndexByte(header, '"'); start >= 0 && (end < 0 || start < end) {
+			if closing := strings.IndexByte(header[start+1:], '"'); closing >= 0 {
+				end = start + 1 + closing + 1
+			}
+		}
+		if end < 0 || end > len(header) {
+			end = len(header)
+		}
+		etags = append(etags, strings.TrimSpace(header[:end]))
+		header = header[end:]
+	}
+}
+
+// copyBody streams an object body using a pooled buffer. A buffer is
+// only ever read back from after io.CopyBuffer has filled it, so data
+// left over from a previous request is never sent.
+func copyBody(dst io.Writer, src io.Reader) (int64, error) {
+	buf := buffers.Get().(*[]byte)
+	defer buffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// sseCustomer returns the algorithm, key and key digest to send with
+// object requests when SSE_C_KEY is configured, or nils otherwise.
+func sseCustomer() (*string, *string, *string) {
+	if len(c.sseCustomerKey) == 0 {
+		return nil, nil, nil
+	}
+	sum := md5.Sum([]byte(c.sseCustomerKey))
+	return aws.String("AES256"), aws.String(c.sseCustomerKey),
+		aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
 
-	return s3.New(sess).GetObject(req)
+// s3head fetches only the metadata of an object. The result is returned
+// as a GetObjectOutput without a body so that it can share the header logic.
+func s3head(ctx context.Context, backet, key, versionID string) (*s3.GetObjectOutput, error) {
+	req := &s3.HeadObjectInput{
+		Bucket: aws.String(backet),
+		Key:    aws.String(key),
+	}
+	req.SSECustomerAlgorithm, req.SSECustomerKey, req.SSECustomerKeyMD5 = sseCustomer()
+	if len(versionID) > 0 {
+		req.VersionId = aws.String(versionID)
+	}
+	head, err := s3For(backet).HeadObjectWithContext(ctx, req)
+	if err != nil && relocate(ctx, backet, err) {
+		head, err = s3For(backet).HeadObjectWithContext(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		AcceptRanges:       head.AcceptRanges,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentLength:      head.ContentLength,
+		ContentType:        head.ContentType,
+		ETag:               head.ETag,
+		Expires:            head.Expires,
+		LastModified:       head.LastModified,
+		Metadata:           head.Metadata,
+	}, nil
 }
 
 func setStrHeader(w http.ResponseWriter, key string, value *string) {
@@ -222,7 +2595,7 @@ func setStrHeader(w http.ResponseWriter, key string, value *string) {
 }
 
 func setIntHeader(w http.ResponseWriter, key string, value *int64) {
-	if value != nil && *value > 0 {
+	if value != nil && *value >= 0 {
 		w.Header().Add(key, strconv.FormatInt(*value, 10))
 	}
 }
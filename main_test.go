@@ -0,0 +1,3959 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+)
+
+func TestMain(m *testing.M) {
+	// Run by configFails: exits like main would on a bad configuration
+	if os.Getenv("TEST_CONFIG_FAILS") == "1" {
+		configFromEnvironmentVariables()
+		os.Exit(0)
+	}
+	// Run by runMain: exits the way main does
+	if os.Getenv("TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	// The configuration is logged every time a test sets it up
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// configFails loads the configuration from env in a subprocess, since bad
+// settings are fatal, and returns what was logged on the way out. The
+// test fails if the configuration turns out to be fine.
+func configFails(t *testing.T, env map[string]string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "TEST_CONFIG_FAILS=1", "AWS_S3_BUCKET=bucket")
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	out, err := cmd.CombinedOutput()
+	if _, exited := err.(*exec.ExitError); !exited {
+		t.Errorf("configuration %v accepted: %v", env, err)
+	}
+	return string(out)
+}
+
+// lastModified is the modification time of every fake object.
+var lastModified = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+type fakeObject struct {
+	body            string
+	contentType     string
+	contentEncoding string
+	cacheControl    string
+	etag            string // defaults to the MD5 of the body
+	metadata        map[string]*string
+}
+
+// fakeS3 serves objects from memory and records the calls made to it.
+// Operations it doesn't implement go to the embedded client, which is
+// only good for presigning since it never reaches S3 in tests.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string]fakeObject // by bucket/key, or bucket/key?versionId=id
+	errors  map[string]error      // returned instead, by bucket or bucket/key
+	calls   []string              // operation and bucket/key, in order
+	gets    []*s3.GetObjectInput
+	heads   []*s3.HeadObjectInput
+	hook    func(ctx aws.Context) error // runs before every operation
+
+	bodyDelay time.Duration // before reading each byte of a body
+	pageSize  int64         // keys per listing page, 1000 if zero
+}
+
+func newFakeS3() *fakeS3 {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}))
+	return &fakeS3{
+		S3API:   s3.New(sess),
+		objects: map[string]fakeObject{},
+		errors:  map[string]error{},
+	}
+}
+
+// s3Error builds an error the way the SDK reports S3 error responses.
+func s3Error(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, http.StatusText(status), nil), status, "REQUESTID")
+}
+
+func (f *fakeS3) put(path string, obj fakeObject) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.objects[path] = obj
+}
+
+// count returns how many times op was called.
+func (f *fakeS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, call := range f.calls {
+		if strings.HasPrefix(call, op+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// begin records a call and returns the error it should fail with, if any.
+func (f *fakeS3) begin(ctx aws.Context, op, path string) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, op+" "+path)
+	hook, err := f.hook, f.errors[path]
+	f.mu.Unlock()
+
+	if hook != nil {
+		if herr := hook(ctx); herr != nil {
+			return herr
+		}
+	}
+	return err
+}
+
+// object looks up an object and its ETag.
+func (f *fakeS3) object(path string) (fakeObject, string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, found := f.objects[path]
+	etag := obj.etag
+	if len(etag) == 0 {
+		etag = fmt.Sprintf(`"%x"`, md5.Sum([]byte(obj.body)))
+	}
+	return obj, etag, found
+}
+
+// objectPath names an object the way the objects map does. The SDK cleans
+// request paths, so the leading slash of the proxy's keys is dropped.
+func objectPath(bucket, key *string) string {
+	return aws.StringValue(bucket) + "/" + strings.TrimPrefix(aws.StringValue(key), "/")
+}
+
+// versionPath names a specific version of an object, or the latest one
+// when versionID is nil.
+func versionPath(path string, versionID *string) string {
+	if versionID == nil {
+		return path
+	}
+	return path + "?versionId=" + *versionID
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	path := versionPath(objectPath(in.Bucket, in.Key), in.VersionId)
+	f.mu.Lock()
+	f.gets = append(f.gets, in)
+	f.mu.Unlock()
+	if err := f.begin(ctx, "GetObject", path); err != nil {
+		return nil, err
+	}
+	obj, etag, found := f.object(path)
+	if !found {
+		return nil, s3Error(s3.ErrCodeNoSuchKey, http.StatusNotFound)
+	}
+
+	if in.IfNoneMatch != nil && listsETag(*in.IfNoneMatch, etag) {
+		return nil, s3Error("NotModified", http.StatusNotModified)
+	}
+	// Like S3, If-Modified-Since only counts without If-None-Match
+	if in.IfNoneMatch == nil && in.IfModifiedSince != nil && !lastModified.After(*in.IfModifiedSince) {
+		return nil, s3Error("NotModified", http.StatusNotModified)
+	}
+
+	out := &s3.GetObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(int64(len(obj.body))),
+		ETag:          aws.String(etag),
+		LastModified:  aws.Time(lastModified),
+		Metadata:      obj.metadata,
+	}
+	if len(obj.contentType) > 0 {
+		out.ContentType = aws.String(obj.contentType)
+	}
+	if len(obj.contentEncoding) > 0 {
+		out.ContentEncoding = aws.String(obj.contentEncoding)
+	}
+	if len(obj.cacheControl) > 0 {
+		out.CacheControl = aws.String(obj.cacheControl)
+	}
+	body := obj.body
+	if in.Range != nil {
+		start, end, ok := parseRange(aws.StringValue(in.Range), int64(len(body)))
+		if ok && start >= int64(len(body)) {
+			return nil, s3Error("InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+		}
+		// Like S3, ignore ranges that can't be parsed
+		if ok {
+			out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+			body = body[start : end+1]
+			out.ContentLength = aws.Int64(int64(len(body)))
+		}
+	}
+	out.Body = &fakeBody{ctx: ctx, r: strings.NewReader(body), delay: f.bodyDelay}
+	return out, nil
+}
+
+// fakeBody fails once the request context is done, like a body read
+// from the network does.
+type fakeBody struct {
+	ctx   aws.Context
+	r     io.Reader
+	delay time.Duration
+}
+
+func (b *fakeBody) Read(p []byte) (int, error) {
+	if b.delay > 0 && len(p) > 0 {
+		time.Sleep(b.delay)
+		p = p[:1]
+	}
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return b.r.Read(p)
+}
+
+func (b *fakeBody) Close() error {
+	return nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	path := versionPath(objectPath(in.Bucket, in.Key), in.VersionId)
+	f.mu.Lock()
+	f.heads = append(f.heads, in)
+	f.mu.Unlock()
+	if err := f.begin(ctx, "HeadObject", path); err != nil {
+		return nil, err
+	}
+	obj, etag, found := f.object(path)
+	if !found {
+		// HEAD responses have no body, so the SDK only knows the status
+		return nil, s3Error("NotFound", http.StatusNotFound)
+	}
+	out := &s3.HeadObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: aws.Int64(int64(len(obj.body))),
+		ETag:          aws.String(etag),
+		LastModified:  aws.Time(lastModified),
+		Metadata:      obj.metadata,
+	}
+	if len(obj.contentType) > 0 {
+		out.ContentType = aws.String(obj.contentType)
+	}
+	if len(obj.contentEncoding) > 0 {
+		out.ContentEncoding = aws.String(obj.contentEncoding)
+	}
+	if len(obj.cacheControl) > 0 {
+		out.CacheControl = aws.String(obj.cacheControl)
+	}
+	return out, nil
+}
+
+func (f *fakeS3) HeadBucketWithContext(ctx aws.Context, in *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	if err := f.begin(ctx, "HeadBucket", aws.StringValue(in.Bucket)); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	bucket := aws.StringValue(in.Bucket)
+	if err := f.begin(ctx, "ListObjectsV2", bucket); err != nil {
+		return nil, err
+	}
+	prefix, delimiter := aws.StringValue(in.Prefix), aws.StringValue(in.Delimiter)
+	maxKeys := aws.Int64Value(in.MaxKeys)
+	if maxKeys == 0 {
+		maxKeys = f.pageSize
+	}
+	if maxKeys == 0 {
+		maxKeys = 1000
+	}
+
+	f.mu.Lock()
+	keys := []string{}
+	for path := range f.objects {
+		if strings.HasPrefix(path, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(path, bucket+"/"))
+		}
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	// The continuation token is the last key or common prefix listed
+	after := aws.StringValue(in.ContinuationToken)
+	out := &s3.ListObjectsV2Output{}
+	last := ""
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after ||
+			(len(delimiter) > 0 && strings.HasSuffix(after, delimiter) && strings.HasPrefix(key, after)) {
+			continue
+		}
+		name := key
+		if i := strings.Index(key[len(prefix):], delimiter); len(delimiter) > 0 && i >= 0 {
+			name = key[:len(prefix)+i+len(delimiter)]
+		}
+		if name == last {
+			continue
+		}
+		if int64(len(out.Contents)+len(out.CommonPrefixes)) == maxKeys {
+			out.NextContinuationToken = aws.String(last)
+			break
+		}
+		last = name
+		if name != key {
+			out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(name)})
+			continue
+		}
+		obj, etag, _ := f.object(bucket + "/" + key)
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.body))),
+			ETag:         aws.String(etag),
+			LastModified: aws.Time(lastModified),
+		})
+	}
+	out.IsTruncated = aws.Bool(out.NextContinuationToken != nil)
+	return out, nil
+}
+
+// listsETag compares the ETags of a condition header the weak way.
+func listsETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses a single bytes=a-b, bytes=a- or bytes=-n range,
+// clamping its end to the object size.
+func parseRange(header string, size int64) (int64, int64, bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	dash := strings.IndexByte(spec, '-')
+	if spec == header || dash < 0 || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last := spec[:dash], spec[dash+1:]
+	if len(first) == 0 {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end := size - 1
+	if len(last) > 0 {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+// setup configures the proxy from env the way main does, with S3
+// replaced by a fake holding no objects.
+func setup(t testing.TB, env map[string]string) *fakeS3 {
+	t.Helper()
+	t.Setenv("AWS_S3_BUCKET", "bucket")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	c = configFromEnvironmentVariables()
+	fake := newFakeS3()
+	svc = fake
+
+	objects = nil
+	if c.cacheMaxBytes > 0 {
+		objects = newObjectCache(c.cacheMaxBytes, c.cacheTTL, c.staleRevalidate)
+	}
+	etags = nil
+	if len(c.immutablePaths) > 0 {
+		etags = newETagCache(10000)
+	}
+	disk = nil
+	if len(c.diskCacheDir) > 0 {
+		dc, err := newDiskCache(c.diskCacheDir, c.diskCacheBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		disk = dc
+	}
+	redirects = nil
+	regionMu.Lock()
+	regionClients = map[string]s3iface.S3API{}
+	relocations = map[string]*relocation{}
+	regionMu.Unlock()
+	keyTemplate = nil
+	if len(c.keyTemplate) > 0 {
+		tmpl, err := parseKeyTemplate(c.keyTemplate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyTemplate = tmpl
+	}
+	// Pooled buffers are sized for the previous configuration
+	buffers = sync.Pool{New: buffers.New}
+	ranges = nil
+	if c.rangeCacheBytes > 0 {
+		ranges = newObjectCache(c.rangeCacheMax, c.cacheTTL, 0)
+	}
+	slots = nil
+	if c.maxConcurrent > 0 {
+		slots = make(chan struct{}, c.maxConcurrent)
+	}
+	return fake
+}
+
+// realS3 builds the client main would use with the current configuration.
+func realS3(t testing.TB) *s3.S3 {
+	t.Helper()
+	client, err := newS3Client(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*s3.S3)
+}
+
+// newRequest builds a request with the given header names and values.
+// Headers with empty values are left out.
+func newRequest(method, target string, header ...string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		if len(header[i+1]) > 0 {
+			r.Header.Set(header[i], header[i+1])
+		}
+	}
+	return r
+}
+
+// serve runs a request through the proxy handler.
+func serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	wrapper(awss3).ServeHTTP(w, r)
+	return w
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		body   string
+	}{
+		{"missing", nil, http.StatusNotFound, "Not Found"},
+		{"NoSuchKey", s3Error(s3.ErrCodeNoSuchKey, 404), http.StatusNotFound, "Not Found"},
+		{"NoSuchBucket", s3Error(s3.ErrCodeNoSuchBucket, 404), http.StatusNotFound, "Not Found"},
+		{"AccessDenied", s3Error("AccessDenied", 403), http.StatusForbidden, "Forbidden"},
+		{"InternalError", s3Error("InternalError", 500), http.StatusInternalServerError, "InternalError"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			if test.err != nil {
+				fake.put("bucket/file.txt", fakeObject{body: "hello"})
+				fake.errors["bucket/file.txt"] = test.err
+			}
+			w := serve(newRequest("GET", "/file.txt"))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if body := w.Body.String(); !strings.Contains(body, test.body) {
+				t.Errorf("body = %q, want it to contain %q", body, test.body)
+			}
+		})
+	}
+
+	fake := setup(t, nil)
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+	if w := serve(newRequest("GET", "/file.txt")); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("existing object: %d %q, want 200 hello", w.Code, w.Body.String())
+	}
+}
+
+func TestRange(t *testing.T) {
+	body := strings.Repeat("0123456789", 50)
+	tests := []struct {
+		rangeHeader  string
+		status       int
+		length       int
+		contentRange string
+	}{
+		{"bytes=0-99", http.StatusPartialContent, 100, "bytes 0-99/500"},
+		{"bytes=450-", http.StatusPartialContent, 50, "bytes 450-499/500"},
+		{"bytes=-10", http.StatusPartialContent, 10, "bytes 490-499/500"},
+		{"", http.StatusOK, 500, ""},
+		{"bytes=abc", http.StatusOK, 500, ""},
+		{"lines=0-99", http.StatusOK, 500, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.rangeHeader, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/video.mp4", fakeObject{body: body})
+			w := serve(newRequest("GET", "/video.mp4", "Range", test.rangeHeader))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if w.Body.Len() != test.length {
+				t.Errorf("got %d bytes, want %d", w.Body.Len(), test.length)
+			}
+			if got := w.Header().Get("Content-Range"); got != test.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, test.contentRange)
+			}
+			if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want bytes", got)
+			}
+		})
+	}
+}
+
+// BenchmarkS3Client compares building a client for every request with
+// sharing one. Requests are only built, never sent.
+func BenchmarkS3Client(b *testing.B) {
+	setup(b, map[string]string{"AWS_REGION": "us-east-1"})
+	in := &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("file.txt")}
+
+	b.Run("PerRequest", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			realS3(b).GetObjectRequest(in)
+		}
+	})
+	b.Run("Shared", func(b *testing.B) {
+		client := realS3(b)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			client.GetObjectRequest(in)
+		}
+	})
+}
+
+func TestHead(t *testing.T) {
+	fake := setup(t, nil)
+	fake.put("bucket/index.html", fakeObject{body: "<h1>hello</h1>", contentType: "text/html"})
+
+	w := serve(newRequest("HEAD", "/index.html"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("body = %q, want none", w.Body.String())
+	}
+	want := map[string]string{
+		"Content-Length": "14",
+		"Content-Type":   "text/html",
+		"Last-Modified":  lastModified.Format(http.TimeFormat),
+		"ETag":           fmt.Sprintf(`"%x"`, md5.Sum([]byte("<h1>hello</h1>"))),
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if n := fake.count("GetObject"); n != 0 {
+		t.Errorf("%d GetObject calls, want none", n)
+	}
+
+	if w := serve(newRequest("HEAD", "/missing.html")); w.Code != http.StatusNotFound {
+		t.Errorf("missing object: status = %d, want 404", w.Code)
+	}
+}
+
+func TestS3Endpoint(t *testing.T) {
+	tests := []struct {
+		endpoint  string
+		pathStyle bool
+	}{
+		{"", false},
+		{"http://localhost:9000", true},
+	}
+	for _, test := range tests {
+		t.Run(test.endpoint, func(t *testing.T) {
+			setup(t, map[string]string{"AWS_REGION": "us-east-1", "S3_ENDPOINT": test.endpoint})
+			if c.s3Endpoint != test.endpoint {
+				t.Errorf("s3Endpoint = %q, want %q", c.s3Endpoint, test.endpoint)
+			}
+			client := realS3(t)
+			if got := aws.StringValue(client.Config.Endpoint); got != test.endpoint {
+				t.Errorf("client endpoint = %q, want %q", got, test.endpoint)
+			}
+			if got := aws.BoolValue(client.Config.S3ForcePathStyle); got != test.pathStyle {
+				t.Errorf("path style = %v, want %v", got, test.pathStyle)
+			}
+		})
+	}
+}
+
+// captureLog sends a logger's output to a buffer for the rest of the test.
+func captureLog(t testing.TB, logger *log.Logger) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	logger.SetOutput(buf)
+	t.Cleanup(func() { logger.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		logger *log.Logger
+	}{
+		{"", accessLogger},
+		{"text", accessLogger},
+		{"json", jsonLogger},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			fake := setup(t, map[string]string{"ACCESS_LOG": "true", "ACCESS_LOG_FORMAT": test.format})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			buf := captureLog(t, test.logger)
+			serve(newRequest("GET", "/file.txt?a=1"))
+
+			line := strings.TrimSpace(buf.String())
+			if test.logger == accessLogger {
+				if !strings.Contains(line, " 200 5 GET /file.txt?a=1 ") {
+					t.Errorf("log = %q, want status, bytes, method and URL", line)
+				}
+				return
+			}
+			entry := accessLogEntry{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("log = %q: %v", line, err)
+			}
+			if entry.Status != 200 || entry.Bytes != 5 || entry.Method != "GET" || entry.Path != "/file.txt" ||
+				len(entry.RemoteAddr) == 0 || entry.DurationMS < 0 {
+				t.Errorf("entry = %+v", entry)
+			}
+		})
+	}
+}
+
+func TestResponseBytes(t *testing.T) {
+	setup(t, nil)
+	tests := [][]string{
+		nil,
+		{""},
+		{"hello"},
+		{"hello", ", ", "world"},
+	}
+	for _, writes := range tests {
+		writer := &custom{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+		want := 0
+		for _, p := range writes {
+			writer.Write([]byte(p))
+			want += len(p)
+		}
+		if writer.bytes != int64(want) {
+			t.Errorf("%q: bytes = %d, want %d", writes, writer.bytes, want)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"reachable", nil, http.StatusOK},
+		{"unreachable", s3Error("AccessDenied", 403), http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"BASIC_AUTH_USER": "user", "BASIC_AUTH_PASS": "pass"})
+			if test.err != nil {
+				fake.errors["bucket"] = test.err
+			}
+			w := httptest.NewRecorder()
+			newServeMux().ServeHTTP(w, newRequest("GET", "/healthz"))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if n := fake.count("HeadBucket"); n != 1 {
+				t.Errorf("%d HeadBucket calls, want 1", n)
+			}
+			// Only the probe skips basic auth
+			w = httptest.NewRecorder()
+			newServeMux().ServeHTTP(w, newRequest("GET", "/file.txt"))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("proxied request: status = %d, want 401", w.Code)
+			}
+		})
+	}
+}
+
+func TestAuthUsers(t *testing.T) {
+	setup(t, map[string]string{
+		"BASIC_AUTH_USERS": "alice:secret1, bob:secret2",
+		"BASIC_AUTH_USER":  "legacy",
+		"BASIC_AUTH_PASS":  "secret3",
+	})
+	tests := []struct {
+		user, pass string
+		allowed    bool
+	}{
+		{"alice", "secret1", true},
+		{"bob", "secret2", true},
+		{"legacy", "secret3", true},
+		{"alice", "secret2", false},
+		{"mallory", "secret1", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		r := newRequest("GET", "/")
+		r.SetBasicAuth(test.user, test.pass)
+		if got := auth(r); got != test.allowed {
+			t.Errorf("%s:%s allowed = %v, want %v", test.user, test.pass, got, test.allowed)
+		}
+	}
+	if auth(newRequest("GET", "/")) {
+		t.Error("request without credentials allowed")
+	}
+}
+
+func TestAuthCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		user, pass string
+		status     int
+	}{
+		{"correct", "user", "pass", http.StatusOK},
+		{"wrong password", "user", "wrong", http.StatusUnauthorized},
+		{"password prefix", "user", "pas", http.StatusUnauthorized},
+		{"wrong user", "admin", "pass", http.StatusUnauthorized},
+		{"empty", "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"BASIC_AUTH_USER": "user", "BASIC_AUTH_PASS": "pass"})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			r := newRequest("GET", "/file.txt")
+			r.SetBasicAuth(test.user, test.pass)
+			w := serve(r)
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if w.Code == http.StatusUnauthorized && len(w.Header().Get("WWW-Authenticate")) == 0 {
+				t.Error("WWW-Authenticate not set")
+			}
+		})
+	}
+}
+
+func TestSecureCompare(t *testing.T) {
+	tests := []struct {
+		given, expected string
+		want            int
+	}{
+		{"secret", "secret", 1},
+		{"secret", "Secret", 0},
+		{"secre", "secret", 0},
+		{"secrets", "secret", 0},
+		{"", "", 1},
+	}
+	for _, test := range tests {
+		if got := secureCompare(test.given, test.expected); got != test.want {
+			t.Errorf("secureCompare(%q, %q) = %d, want %d", test.given, test.expected, got, test.want)
+		}
+	}
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	setup(t, map[string]string{"SHUTDOWN_TIMEOUT": "5s"})
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			results <- result{"", err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	sig := make(chan os.Signal, 1)
+	idle := shutdownOnSignal(sig, nil, srv)
+	sig <- syscall.SIGTERM
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatalf("Serve = %v, want ErrServerClosed", err)
+	}
+	select {
+	case <-idle:
+		t.Fatal("shut down with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if res := <-results; res.err != nil || res.body != "done" {
+		t.Errorf("in-flight request = %q, %v; want done", res.body, res.err)
+	}
+	select {
+	case <-idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown never finished")
+	}
+}
+
+func TestIndexDocument(t *testing.T) {
+	tests := []struct {
+		indexDocument string
+		key           string
+	}{
+		{"", "bucket/docs/index.html"},
+		{"index.htm", "bucket/docs/index.htm"},
+		{"default.html", "bucket/docs/default.html"},
+	}
+	for _, test := range tests {
+		t.Run(test.indexDocument, func(t *testing.T) {
+			fake := setup(t, map[string]string{"INDEX_DOCUMENT": test.indexDocument})
+			fake.put(test.key, fakeObject{body: "index"})
+			w := serve(newRequest("GET", "/docs/"))
+			if w.Code != http.StatusOK || w.Body.String() != "index" {
+				t.Errorf("got %d %q, want 200 index", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSPAMode(t *testing.T) {
+	tests := []struct {
+		spaMode string
+		path    string
+		status  int
+		body    string
+	}{
+		{"true", "/app/users/42", http.StatusOK, "app"},
+		{"true", "/styles/missing.css", http.StatusNotFound, "Not Found"},
+		{"true", "/real.txt", http.StatusOK, "real"},
+		{"false", "/app/users/42", http.StatusNotFound, "Not Found"},
+	}
+	for _, test := range tests {
+		t.Run(test.spaMode+test.path, func(t *testing.T) {
+			fake := setup(t, map[string]string{"SPA_MODE": test.spaMode})
+			fake.put("bucket/index.html", fakeObject{body: "app"})
+			fake.put("bucket/real.txt", fakeObject{body: "real"})
+			w := serve(newRequest("GET", test.path))
+			if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), test.status, test.body)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowOrigin string
+		method      string
+		origin      string
+		status      int
+		allowed     string
+		methods     string
+	}{
+		{"wildcard preflight", "*", "OPTIONS", "https://a.example", http.StatusNoContent, "*", "GET, HEAD"},
+		{"wildcard GET", "*", "GET", "https://a.example", http.StatusOK, "*", ""},
+		{"exact preflight", "https://a.example,https://b.example", "OPTIONS", "https://b.example", http.StatusNoContent, "https://b.example", "GET, HEAD"},
+		{"exact GET", "https://a.example,https://b.example", "GET", "https://a.example", http.StatusOK, "https://a.example", ""},
+		{"other origin preflight", "https://a.example", "OPTIONS", "https://evil.example", http.StatusNoContent, "", ""},
+		{"other origin GET", "https://a.example", "GET", "https://evil.example", http.StatusOK, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{
+				"CORS_ALLOW_ORIGIN":  test.allowOrigin,
+				"CORS_ALLOW_HEADERS": "Range",
+				// Preflight requests never carry credentials
+				"BASIC_AUTH_USER": "user",
+				"BASIC_AUTH_PASS": "pass",
+			})
+			fake.put("bucket/font.woff2", fakeObject{body: "font"})
+			r := newRequest(test.method, "/font.woff2", "Origin", test.origin)
+			if test.method != "OPTIONS" {
+				r.SetBasicAuth("user", "pass")
+			}
+			w := serve(r)
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allowed {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, test.allowed)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != test.methods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, test.methods)
+			}
+			vary := test.allowed != "" && test.allowed != "*"
+			if got := strings.Contains(strings.Join(w.Header()["Vary"], ","), "Origin"); got != vary {
+				t.Errorf("Vary: Origin = %v, want %v", got, vary)
+			}
+			if test.method == "OPTIONS" && fake.count("GetObject")+fake.count("HeadObject") > 0 {
+				t.Error("preflight reached S3")
+			}
+		})
+	}
+}
+
+func TestErrorDocument404(t *testing.T) {
+	tests := []struct {
+		name        string
+		page        *fakeObject
+		body        string
+		contentType string
+	}{
+		{"present", &fakeObject{body: "<h1>Lost?</h1>", contentType: "text/html"}, "<h1>Lost?</h1>", "text/html"},
+		{"absent", nil, "Not Found\n", "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"ERROR_DOCUMENT_404": "/errors/404.html"})
+			if test.page != nil {
+				fake.put("bucket/errors/404.html", *test.page)
+			}
+			w := serve(newRequest("GET", "/missing.html"))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", w.Code)
+			}
+			if w.Body.String() != test.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), test.body)
+			}
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, test.contentType)
+			}
+		})
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	tests := []struct {
+		name   string
+		since  string
+		status int
+		body   string
+	}{
+		{"unchanged", lastModified.Format(http.TimeFormat), http.StatusNotModified, ""},
+		{"later", lastModified.Add(time.Hour).Format(http.TimeFormat), http.StatusNotModified, ""},
+		{"modified", lastModified.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK, "hello"},
+		{"invalid date", "yesterday", http.StatusOK, "hello"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			w := serve(newRequest("GET", "/file.txt", "If-Modified-Since", test.since))
+			if w.Code != test.status || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), test.status, test.body)
+			}
+		})
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		etag        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"strong match", `"abc"`, `"abc"`, http.StatusNotModified},
+		{"weak match", `W/"abc"`, `W/"abc"`, http.StatusNotModified},
+		{"one of several", `"abc"`, `"xyz", "abc"`, http.StatusNotModified},
+		{"multipart", `"abc-5"`, `"abc-5"`, http.StatusNotModified},
+		{"multipart, other parts", `"abc-5"`, `"abc-6"`, http.StatusOK},
+		{"multipart, digest only", `"abc-5"`, `"abc"`, http.StatusOK},
+		{"no match", `"abc"`, `"xyz"`, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/file.txt", fakeObject{body: "hello", etag: test.etag})
+			w := serve(newRequest("GET", "/file.txt", "If-None-Match", test.ifNoneMatch))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if in := fake.gets[0]; aws.StringValue(in.IfNoneMatch) != test.ifNoneMatch {
+				t.Errorf("IfNoneMatch = %q, want it passed through verbatim", aws.StringValue(in.IfNoneMatch))
+			}
+			if test.status == http.StatusOK && w.Header().Get("ETag") != test.etag {
+				t.Errorf("ETag = %q, want %q", w.Header().Get("ETag"), test.etag)
+			}
+		})
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		etag   string
+		want   bool
+	}{
+		{`"abc-5"`, `"abc-5"`, true},
+		{`W/"abc-5"`, `"abc-5"`, true},
+		{`"xyz", "abc-5"`, `"abc-5"`, true},
+		{`"abc-6"`, `"abc-5"`, false},
+		{`"abc"`, `"abc-5"`, false},
+		{`"abc-5"`, `"abc"`, false},
+		{`"a,b-2"`, `"a,b-2"`, true},
+		{`"a,b-2"`, `"b-2"`, false},
+		{`*`, `"abc-5"`, true},
+		{``, `"abc-5"`, false},
+		{`"abc-5"`, ``, false},
+	}
+	for _, test := range tests {
+		if got := etagMatches(test.header, test.etag); got != test.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", test.header, test.etag, got, test.want)
+		}
+	}
+}
+
+// TestMultipartETag checks the local If-None-Match comparison for
+// immutable paths, which must treat multipart ETags as opaque strings
+// just like S3 does.
+func TestMultipartETag(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"same", `"abc-5"`, http.StatusNotModified},
+		{"other parts", `"abc-6"`, http.StatusOK},
+		{"digest only", `"abc"`, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"IMMUTABLE_PATHS": "*.js"})
+			fake.put("bucket/app.js", fakeObject{body: "x", etag: `"abc-5"`})
+			serve(newRequest("GET", "/app.js"))
+
+			w := serve(newRequest("GET", "/app.js", "If-None-Match", test.ifNoneMatch))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("ETag"); got != `"abc-5"` {
+				t.Errorf("ETag = %q, want it unchanged", got)
+			}
+		})
+	}
+}
+
+func TestS3Timeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		delay  time.Duration
+		status int
+	}{
+		{"fast", 0, http.StatusOK},
+		{"slow", time.Second, http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			c.s3Timeout = 50 * time.Millisecond
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			fake.hook = func(ctx aws.Context) error {
+				select {
+				case <-time.After(test.delay):
+					return nil
+				case <-ctx.Done():
+					return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+				}
+			}
+			w := serve(newRequest("GET", "/file.txt"))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+// slowBody hands out its data in small pieces, sleeping before each.
+type slowBody struct {
+	data  string
+	delay time.Duration
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(b.delay)
+	n := copy(p[:1], b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func TestS3TimeoutSparesBody(t *testing.T) {
+	fake := setup(t, nil)
+	c.s3Timeout = 50 * time.Millisecond
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+	// Streaming takes 100ms, twice S3_TIMEOUT
+	fake.bodyDelay = 20 * time.Millisecond
+
+	w := serve(newRequest("GET", "/file.txt"))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("got %d %q, want 200 hello", w.Code, w.Body.String())
+	}
+}
+
+func TestClientCancellation(t *testing.T) {
+	fake := setup(t, nil)
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+	started, cancelled := make(chan struct{}), make(chan error, 1)
+	fake.hook = func(ctx aws.Context) error {
+		close(started)
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+			return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRequest("GET", "/file.txt").WithContext(ctx)
+	go func() {
+		<-started
+		cancel()
+	}()
+	serve(r)
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("S3 call saw %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDisableIndex(t *testing.T) {
+	tests := []struct {
+		disableIndex string
+		key          string
+	}{
+		{"true", "/docs/"},
+		{"false", "/docs/index.html"},
+	}
+	for _, test := range tests {
+		t.Run(test.disableIndex, func(t *testing.T) {
+			fake := setup(t, map[string]string{"DISABLE_INDEX": test.disableIndex})
+			fake.put("bucket/docs/", fakeObject{body: "folder object"})
+			fake.put("bucket/docs/index.html", fakeObject{body: "index"})
+			serve(newRequest("GET", "/docs/"))
+			if got := aws.StringValue(fake.gets[0].Key); got != test.key {
+				t.Errorf("key = %q, want %q", got, test.key)
+			}
+		})
+	}
+}
+
+// credentialsProvider digs the provider out of a client's credentials.
+func credentialsProvider(client *s3.S3) reflect.Value {
+	return reflect.ValueOf(client.Config.Credentials).Elem().FieldByName("provider").Elem()
+}
+
+func TestAssumeRole(t *testing.T) {
+	tests := []struct {
+		roleARN     string
+		sessionName string
+	}{
+		{"arn:aws:iam::123456789012:role/reader", "proxy"},
+		{"arn:aws:iam::123456789012:role/reader", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.roleARN+test.sessionName, func(t *testing.T) {
+			setup(t, map[string]string{
+				"AWS_REGION":            "us-east-1",
+				"AWS_ROLE_ARN":          test.roleARN,
+				"AWS_ROLE_SESSION_NAME": test.sessionName,
+			})
+			provider := credentialsProvider(realS3(t))
+			assumed := provider.Type() == reflect.TypeOf(&stscreds.AssumeRoleProvider{})
+			if assumed != (len(test.roleARN) > 0) {
+				t.Fatalf("provider = %v with AWS_ROLE_ARN %q", provider.Type(), test.roleARN)
+			}
+			if !assumed {
+				return
+			}
+			if got := provider.Elem().FieldByName("RoleARN").String(); got != test.roleARN {
+				t.Errorf("RoleARN = %q, want %q", got, test.roleARN)
+			}
+			if got := provider.Elem().FieldByName("RoleSessionName").String(); len(test.sessionName) > 0 && got != test.sessionName {
+				t.Errorf("RoleSessionName = %q, want %q", got, test.sessionName)
+			}
+		})
+	}
+}
+
+func TestDefaultCredentialChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		keyID    string
+		provider interface{}
+	}{
+		{"static keys", "AKID", &credentials.StaticProvider{}},
+		{"no keys", "", &credentials.ChainProvider{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t, map[string]string{
+				"AWS_REGION":                  "us-east-1",
+				"AWS_ACCESS_KEY_ID":           test.keyID,
+				"AWS_SECRET_ACCESS_KEY":       test.keyID,
+				"AWS_PROFILE":                 "",
+				"AWS_SHARED_CREDENTIALS_FILE": "/nonexistent",
+				"AWS_CONFIG_FILE":             "/nonexistent",
+			})
+			provider := credentialsProvider(realS3(t))
+			if want := reflect.TypeOf(test.provider); provider.Type() != want {
+				t.Errorf("provider = %v, want %v", provider.Type(), want)
+			}
+		})
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		host string
+		addr string
+	}{
+		{"", ":8080"},
+		{"127.0.0.1", "127.0.0.1:8080"},
+		{"::1", "[::1]:8080"},
+	}
+	for _, test := range tests {
+		setup(t, map[string]string{"APP_HOST": test.host, "APP_PORT": "8080"})
+		if got := newServer(http.NotFoundHandler()).Addr; got != test.addr {
+			t.Errorf("APP_HOST %q: address = %q, want %q", test.host, got, test.addr)
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		port     string
+		target   string
+		host     string
+		location string
+	}{
+		{"443", "/docs/a%20b.pdf?page=2", "example.com", "https://example.com/docs/a%20b.pdf?page=2"},
+		{"443", "/", "example.com:80", "https://example.com/"},
+		{"8443", "/file.txt", "example.com:8080", "https://example.com:8443/file.txt"},
+		{"443", "/file.txt", "[::1]:80", "https://[::1]/file.txt"},
+		{"8443", "/file.txt", "[::1]", "https://[::1]:8443/file.txt"},
+	}
+	for _, test := range tests {
+		setup(t, map[string]string{"APP_PORT": test.port})
+		r := newRequest("GET", test.target)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		redirectToHTTPS(w, r)
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s%s: status = %d, want 301", test.host, test.target, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != test.location {
+			t.Errorf("%s%s: Location = %q, want %q", test.host, test.target, got, test.location)
+		}
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+	}{
+		{"1.0", tls.VersionTLS10},
+		{"1.1", tls.VersionTLS11},
+		{"1.2", tls.VersionTLS12},
+		{"1.3", tls.VersionTLS13},
+	}
+	for _, test := range tests {
+		if got, err := parseTLSVersion(test.version); err != nil || got != test.want {
+			t.Errorf("parseTLSVersion(%q) = %x, %v; want %x", test.version, got, err, test.want)
+		}
+	}
+	for _, version := range []string{"", "1", "TLS1.2", "1.4", "SSLv3"} {
+		if _, err := parseTLSVersion(version); err == nil {
+			t.Errorf("parseTLSVersion(%q) accepted", version)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		names string
+		want  []uint16
+	}{
+		{"", nil},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+	}
+	for _, test := range tests {
+		if got, err := parseCipherSuites(test.names); err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCipherSuites(%q) = %v, %v; want %v", test.names, got, err, test.want)
+		}
+	}
+	if _, err := parseCipherSuites("TLS_MADE_UP"); err == nil {
+		t.Error("unknown cipher suite accepted")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	setup(t, nil)
+	if got := newServer(http.NotFoundHandler()).TLSConfig.MinVersion; got != tls.VersionTLS12 {
+		t.Errorf("default minimum version = %x, want TLS 1.2", got)
+	}
+	setup(t, map[string]string{"TLS_MIN_VERSION": "1.3"})
+	if got := newServer(http.NotFoundHandler()).TLSConfig.MinVersion; got != tls.VersionTLS13 {
+		t.Errorf("minimum version = %x, want TLS 1.3", got)
+	}
+	if out := configFails(t, map[string]string{"TLS_MIN_VERSION": "1.4"}); !strings.Contains(out, "unknown TLS version: 1.4") {
+		t.Errorf("TLS_MIN_VERSION=1.4 logged %q", out)
+	}
+}
+
+func TestBucketMap(t *testing.T) {
+	tests := []struct {
+		host   string
+		bucket string
+	}{
+		{"foo.example.com", "foo-assets"},
+		{"bar.example.com", "bar-assets"},
+		{"foo.example.com:8080", "foo-assets"},
+		{"FOO.example.com", "foo-assets"},
+		{"other.example.com", "bucket"},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			fake := setup(t, map[string]string{"BUCKET_MAP": "foo.example.com=foo-assets,bar.example.com=bar-assets"})
+			fake.put(test.bucket+"/file.txt", fakeObject{body: test.bucket})
+			r := newRequest("GET", "/file.txt")
+			r.Host = test.host
+			if w := serve(r); w.Code != http.StatusOK || w.Body.String() != test.bucket {
+				t.Errorf("got %d %q, want 200 from %s", w.Code, w.Body.String(), test.bucket)
+			}
+		})
+	}
+}
+
+func TestPathRoutes(t *testing.T) {
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{"/site/docs/guide.html", "docs-bucket/manual/guide.html"},
+		{"/site/index.css", "site-bucket/www/index.css"},
+		{"/site", "site-bucket/www/index.html"},
+		{"/sitemap.xml", "bucket/sitemap.xml"},
+		{"/other/file.txt", "bucket/other/file.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			fake := setup(t, map[string]string{"PATH_ROUTES": "/site=site-bucket:www, /site/docs=docs-bucket:manual"})
+			fake.put(test.key, fakeObject{body: test.key})
+			if w := serve(newRequest("GET", test.path)); w.Body.String() != test.key {
+				t.Errorf("got %d %q, want %s", w.Code, w.Body.String(), test.key)
+			}
+		})
+	}
+}
+
+func TestGuessContentType(t *testing.T) {
+	tests := []struct {
+		key         string
+		contentType string
+		want        string
+	}{
+		{"style.css", "", "text/css; charset=utf-8"},
+		{"logo.svg", "application/octet-stream", "image/svg+xml"},
+		{"data.unknownext", "", ""},
+		{"blob.unknownext", "application/octet-stream", "application/octet-stream"},
+		{"page.css", "text/x-custom", "text/x-custom"},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/"+test.key, fakeObject{body: "content", contentType: test.contentType})
+			w := serve(newRequest("GET", "/"+test.key))
+			if got := w.Header().Get("Content-Type"); got != test.want {
+				t.Errorf("Content-Type = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// putSymlink stores a symlink.json pointing to url.
+func (f *fakeS3) putSymlink(path, url string) {
+	f.put(path, fakeObject{body: `{"URL": "` + url + `"}`, contentType: "application/json"})
+}
+
+func TestSymlinkChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDepth string
+		links    map[string]string
+		status   int
+	}{
+		{"one hop", "", map[string]string{"a": "/c"}, http.StatusOK},
+		{"two hops", "", map[string]string{"a": "/b/symlink.json", "b": "/c"}, http.StatusOK},
+		{"too deep", "1", map[string]string{"a": "/b/symlink.json", "b": "/c"}, http.StatusLoopDetected},
+		{"self", "", map[string]string{"a": "/a/symlink.json"}, http.StatusLoopDetected},
+		{"cycle", "", map[string]string{"a": "/b/symlink.json", "b": "/a/symlink.json"}, http.StatusLoopDetected},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"SYMLINK_MAX_DEPTH": test.maxDepth})
+			for dir, url := range test.links {
+				fake.putSymlink("bucket/"+dir+"/symlink.json", url)
+			}
+			fake.put("bucket/c/file.txt", fakeObject{body: "target"})
+			w := serve(newRequest("GET", "/a/symlink.json/file.txt"))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if test.status == http.StatusOK && w.Body.String() != "target" {
+				t.Errorf("body = %q, want target", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSymlinkAllowPrefixes(t *testing.T) {
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/tenant-a/v2", http.StatusOK},
+		{"/tenant-a", http.StatusOK},
+		{"/tenant-b/v2", http.StatusForbidden},
+		{"/tenant-a/../tenant-b/v2", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			fake := setup(t, map[string]string{"SYMLINK_ALLOW_PREFIXES": "/tenant-a/"})
+			fake.putSymlink("bucket/latest/symlink.json", test.url)
+			fake.put("bucket/tenant-a/v2/file.txt", fakeObject{body: "a"})
+			fake.put("bucket/tenant-a/file.txt", fakeObject{body: "a"})
+			fake.put("bucket/tenant-b/v2/file.txt", fakeObject{body: "b"})
+			if w := serve(newRequest("GET", "/latest/symlink.json/file.txt")); w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+	}{
+		{"generated", ""},
+		{"from client", "abc-123"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"ACCESS_LOG": "true"})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			buf := captureLog(t, accessLogger)
+			w := serve(newRequest("GET", "/file.txt", "X-Request-Id", test.clientID))
+
+			id := w.Header().Get("X-Request-Id")
+			if len(id) == 0 || (len(test.clientID) > 0 && id != test.clientID) {
+				t.Errorf("X-Request-Id = %q, want %q or a new ID", id, test.clientID)
+			}
+			if line := strings.TrimSpace(buf.String()); !strings.HasSuffix(line, " "+id) {
+				t.Errorf("log = %q, want it to end with %s", line, id)
+			}
+		})
+	}
+	if a, b := newRequestID(), newRequestID(); a == b {
+		t.Errorf("request IDs repeat: %s", a)
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	fake := setup(t, map[string]string{
+		"CUSTOM_HEADERS": "X-Content-Type-Options:nosniff|Strict-Transport-Security: max-age=31536000|x-frame-options:DENY|Cache-Control:no-store",
+	})
+	fake.put("bucket/file.txt", fakeObject{body: "hello", cacheControl: "max-age=60"})
+
+	for _, target := range []string{"/file.txt", "/missing.txt"} {
+		w := serve(newRequest("GET", target))
+		want := map[string]string{
+			"X-Content-Type-Options":    "nosniff",
+			"Strict-Transport-Security": "max-age=31536000",
+			"X-Frame-Options":           "DENY",
+		}
+		for name, value := range want {
+			if got := w.Header().Get(name); got != value {
+				t.Errorf("%s: %s = %q, want %q", target, name, got, value)
+			}
+		}
+	}
+	// Headers from S3 win
+	if got := serve(newRequest("GET", "/file.txt")).Header().Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Cache-Control = %q, want the one from S3", got)
+	}
+}
+
+func TestURLPrefixStrip(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+		key    string
+	}{
+		{"/downloads/file.zip", http.StatusOK, "/file.zip"},
+		{"/downloads/nested/file.zip", http.StatusOK, "/nested/file.zip"},
+		{"/downloads", http.StatusOK, "/index.html"},
+		{"/downloadsfile.zip", http.StatusNotFound, ""},
+		{"/file.zip", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			fake := setup(t, map[string]string{"URL_PREFIX_STRIP": "/downloads"})
+			fake.putTree("bucket", "file.zip", "nested/file.zip", "index.html", "downloads/file.zip")
+			w := serve(newRequest("GET", test.path))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if len(test.key) == 0 {
+				if len(fake.gets) > 0 {
+					t.Errorf("fetched %s, want no S3 request", aws.StringValue(fake.gets[0].Key))
+				}
+				return
+			}
+			if got := aws.StringValue(fake.gets[0].Key); got != test.key {
+				t.Errorf("key = %q, want %q", got, test.key)
+			}
+		})
+	}
+}
+
+func TestIPAccess(t *testing.T) {
+	tests := []struct {
+		addr   string
+		status int
+	}{
+		{"10.1.2.3:1234", http.StatusOK},
+		{"10.9.0.1:1234", http.StatusForbidden},
+		{"192.168.1.1:1234", http.StatusForbidden},
+		{"[fd00::1]:1234", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			fake := setup(t, map[string]string{
+				"IP_ALLOW_CIDRS": "10.0.0.0/8, fd00::/8",
+				"IP_DENY_CIDRS":  "10.9.0.0/16",
+			})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			r := newRequest("GET", "/file.txt")
+			r.RemoteAddr = test.addr
+			if w := serve(r); w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	for _, name := range []string{"IP_ALLOW_CIDRS", "IP_DENY_CIDRS"} {
+		if out := configFails(t, map[string]string{name: "10.0.0.0/33"}); !strings.Contains(out, name) {
+			t.Errorf("%s=10.0.0.0/33 logged %q", name, out)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name string
+		peer string
+		xff  string
+		want string
+	}{
+		{"untrusted peer", "203.0.113.9:1234", "198.51.100.1", "203.0.113.9:1234"},
+		{"trusted peer", "10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"spoofed hop", "10.0.0.1:1234", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"trusted chain", "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"no header", "10.0.0.1:1234", "", "10.0.0.1:1234"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8"})
+			r := newRequest("GET", "/", "X-Forwarded-For", test.xff)
+			r.RemoteAddr = test.peer
+			if got := clientAddr(r); got != test.want {
+				t.Errorf("clientAddr = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"ipv4", []string{"for=192.0.2.60;proto=https;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{"ipv6", []string{`for="[2001:db8:cafe::17]"`}, []string{"[2001:db8:cafe::17]"}},
+		{"ipv6 and port", []string{`For="[2001:db8:cafe::17]:4711"`}, []string{"[2001:db8:cafe::17]:4711"}},
+		{"list", []string{"for=192.0.2.43, for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"repeated headers", []string{"for=192.0.2.43", "proto=http;for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"no for", []string{"proto=https;by=203.0.113.43"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := forwardedFor(test.values); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("forwardedFor(%q) = %q, want %q", test.values, got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientIPHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   string
+		xff       string
+		forwarded string
+		want      string
+	}{
+		{"forwarded", "", "", `for="[2001:db8::1]:4711"`, "[2001:db8::1]:4711"},
+		{"x-forwarded-for first", "", "198.51.100.1", "for=198.51.100.2", "198.51.100.1"},
+		{"forwarded first", "forwarded, x-forwarded-for", "198.51.100.1", "for=198.51.100.2", "198.51.100.2"},
+		{"fallback", "forwarded,x-forwarded-for", "198.51.100.1", "", "198.51.100.1"},
+		{"not listed", "x-forwarded-for", "", "for=198.51.100.2", "10.0.0.1:1234"},
+		{"trusted hops", "", "", "for=198.51.100.2, for=10.0.0.2", "198.51.100.2"},
+		{"no for", "", "", "proto=https", "10.0.0.1:1234"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8", "CLIENT_IP_HEADERS": test.headers})
+			r := newRequest("GET", "/", "X-Forwarded-For", test.xff, "Forwarded", test.forwarded)
+			r.RemoteAddr = "10.0.0.1:1234"
+			if got := clientAddr(r); got != test.want {
+				t.Errorf("clientAddr = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestForwardedIPRules(t *testing.T) {
+	tests := []struct {
+		forwarded string
+		status    int
+	}{
+		{`for="[fd00::1]:4711"`, http.StatusOK},
+		{`for="[2001:db8::1]"`, http.StatusForbidden},
+		{"for=10.1.2.3", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.forwarded, func(t *testing.T) {
+			fake := setup(t, map[string]string{
+				"TRUSTED_PROXIES": "192.0.2.0/24",
+				"IP_ALLOW_CIDRS":  "10.0.0.0/8, fd00::/8",
+			})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			r := newRequest("GET", "/file.txt", "Forwarded", test.forwarded)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if w := serve(r); w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestS3Retries(t *testing.T) {
+	tests := []struct {
+		maxRetries string
+		attempts   int
+		status     int
+	}{
+		{"3", 3, http.StatusOK},
+		{"1", 2, http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.maxRetries, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if attempts++; attempts <= 2 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					fmt.Fprint(w, `<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)
+					return
+				}
+				w.Write([]byte("hello"))
+			}))
+			defer server.Close()
+
+			setup(t, map[string]string{
+				"AWS_REGION":            "us-east-1",
+				"AWS_ACCESS_KEY_ID":     "AKID",
+				"AWS_SECRET_ACCESS_KEY": "SECRET",
+				"S3_ENDPOINT":           server.URL,
+				"S3_MAX_RETRIES":        test.maxRetries,
+			})
+			svc = realS3(t)
+			w := serve(newRequest("GET", "/file.txt"))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if attempts != test.attempts {
+				t.Errorf("%d attempts, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestS3RetriesGiveUpWithContext(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	setup(t, map[string]string{
+		"AWS_REGION":            "us-east-1",
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+		"S3_ENDPOINT":           server.URL,
+		"S3_MAX_RETRIES":        "1000",
+	})
+	c.s3Timeout = 200 * time.Millisecond
+	svc = realS3(t)
+	start := time.Now()
+	if w := serve(newRequest("GET", "/file.txt")); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %v and %d attempts", elapsed, attempts)
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifRange string
+		status  int
+		length  int
+	}{
+		{"matching ETag", `"v1"`, http.StatusPartialContent, 10},
+		{"stale ETag", `"v0"`, http.StatusOK, 100},
+		{"weak ETag", `W/"v1"`, http.StatusOK, 100},
+		{"matching date", lastModified.Format(http.TimeFormat), http.StatusPartialContent, 10},
+		{"stale date", lastModified.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/file.bin", fakeObject{body: strings.Repeat("b", 100), etag: `"v1"`})
+			w := serve(newRequest("GET", "/file.bin", "Range", "bytes=0-9", "If-Range", test.ifRange))
+			if w.Code != test.status || w.Body.Len() != test.length {
+				t.Errorf("got %d with %d bytes, want %d with %d", w.Code, w.Body.Len(), test.status, test.length)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	fake := setup(t, map[string]string{"MAX_CONCURRENT_REQUESTS": "2", "CONCURRENCY_WAIT": "50ms"})
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+	started, release := make(chan struct{}), make(chan struct{})
+	held := make(chan struct{}, 2)
+	fake.hook = func(ctx aws.Context) error {
+		// Only the first two calls wait, so that a call made past
+		// the limit fails the test instead of hanging it
+		select {
+		case held <- struct{}{}:
+			started <- struct{}{}
+			<-release
+		default:
+		}
+		return nil
+	}
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { codes <- serve(newRequest("GET", "/file.txt")).Code }()
+		<-started
+	}
+	w := serve(newRequest("GET", "/file.txt"))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("over the limit: %d with Retry-After %q, want 503 with 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	// Symlinks are resolved within the slot too
+	fake.putSymlink("bucket/latest/symlink.json", "/v2")
+	gets := fake.count("GetObject")
+	if w := serve(newRequest("GET", "/latest/symlink.json/file.txt")); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("symlink over the limit: status = %d, want 503", w.Code)
+	}
+	if n := fake.count("GetObject") - gets; n != 0 {
+		t.Errorf("symlink over the limit: %d GetObject calls, want none", n)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("within the limit: status = %d, want 200", code)
+		}
+	}
+	// The slots are free again
+	fake.hook = nil
+	if w := serve(newRequest("GET", "/file.txt")); w.Code != http.StatusOK {
+		t.Errorf("after release: status = %d, want 200", w.Code)
+	}
+}
+
+func TestRootObject(t *testing.T) {
+	tests := []struct {
+		rootObject string
+		path       string
+		key        string
+	}{
+		{"/home/welcome.html", "/", "/home/welcome.html"},
+		{"/home/welcome.html", "/sub/", "/sub/index.html"},
+		{"home.html", "/", "/home.html"},
+		{"", "/", "/index.html"},
+	}
+	for _, test := range tests {
+		t.Run(test.rootObject+test.path, func(t *testing.T) {
+			fake := setup(t, map[string]string{"ROOT_OBJECT": test.rootObject})
+			serve(newRequest("GET", test.path))
+			if got := aws.StringValue(fake.gets[0].Key); got != test.key {
+				t.Errorf("key = %q, want %q", got, test.key)
+			}
+		})
+	}
+}
+
+func TestVary(t *testing.T) {
+	html := strings.Repeat("<p>hello</p>", 200)
+	tests := []struct {
+		name   string
+		env    map[string]string
+		target string
+		vary   string
+	}{
+		{"plain", nil, "/page.html", ""},
+		{"gzip", map[string]string{"GZIP_ENABLED": "true"}, "/page.html", "Accept-Encoding"},
+		{"gzip, incompressible", map[string]string{"GZIP_ENABLED": "true"}, "/photo.jpg", ""},
+		{"precompressed", map[string]string{"SERVE_PRECOMPRESSED": "true"}, "/page.html", "Accept-Encoding"},
+		{"listing", map[string]string{"DIRECTORY_LISTING": "true"}, "/dir/", "Accept"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, test.env)
+			fake.put("bucket/page.html", fakeObject{body: html, contentType: "text/html"})
+			fake.put("bucket/photo.jpg", fakeObject{body: html, contentType: "image/jpeg"})
+			fake.put("bucket/dir/file.txt", fakeObject{body: "file"})
+			w := serve(newRequest("GET", test.target, "Accept-Encoding", "gzip"))
+			if got := strings.Join(w.Header()["Vary"], ", "); got != test.vary {
+				t.Errorf("Vary = %q, want %q", got, test.vary)
+			}
+		})
+	}
+
+	setup(t, nil)
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, newRequest("GET", "/--version"))
+	if got := w.Header().Get("Vary"); got != "Accept" {
+		t.Errorf("/--version: Vary = %q, want Accept", got)
+	}
+}
+
+func TestVersionAccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  string
+		target string
+		status int
+		body   string
+	}{
+		{"latest", "true", "/file.txt", http.StatusOK, "latest"},
+		{"version", "true", "/file.txt?versionId=v1", http.StatusOK, "first"},
+		{"missing version", "true", "/file.txt?versionId=v2", http.StatusNotFound, "Not Found\n"},
+		{"disabled", "false", "/file.txt?versionId=v1", http.StatusOK, "latest"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"ALLOW_VERSION_ACCESS": test.allow})
+			fake.put("bucket/file.txt", fakeObject{body: "latest"})
+			fake.put("bucket/file.txt?versionId=v1", fakeObject{body: "first"})
+
+			w := serve(newRequest("GET", test.target))
+			if w.Code != test.status || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), test.status, test.body)
+			}
+		})
+	}
+
+	// Only the requested version is large enough to be redirected
+	t.Run("redirect", func(t *testing.T) {
+		fake := setup(t, map[string]string{"ALLOW_VERSION_ACCESS": "true", "REDIRECT_THRESHOLD_BYTES": "10"})
+		fake.put("bucket/file.txt", fakeObject{body: "latest"})
+		fake.put("bucket/file.txt?versionId=v1", fakeObject{body: "the first version"})
+
+		w := serve(newRequest("GET", "/file.txt?versionId=v1"))
+		if w.Code != http.StatusFound {
+			t.Fatalf("status = %d, want 302", w.Code)
+		}
+		if u := presignedURL(t, w.Header().Get("Location")); u.Query().Get("versionId") != "v1" {
+			t.Errorf("redirected to %s, want version v1", u)
+		}
+	})
+}
+
+func TestDirectoryRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect string
+		target   string
+		status   int
+		location string
+	}{
+		{"directory", "true", "/blog", http.StatusMovedPermanently, "/blog/"},
+		{"query kept", "true", "/blog?page=2", http.StatusMovedPermanently, "/blog/?page=2"},
+		{"sibling prefix", "true", "/blo", http.StatusNotFound, ""},
+		{"missing", "true", "/missing", http.StatusNotFound, ""},
+		{"file", "true", "/blog/post.html", http.StatusOK, ""},
+		{"disabled", "false", "/blog", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"DIRECTORY_REDIRECT": test.redirect})
+			fake.put("bucket/blog/post.html", fakeObject{body: "post"})
+
+			w := serve(newRequest("GET", test.target))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("Location"); got != test.location {
+				t.Errorf("Location = %q, want %q", got, test.location)
+			}
+		})
+	}
+}
+
+func TestCacheControlRules(t *testing.T) {
+	rules := "*.js=max-age=31536000, immutable|.html=no-cache|/static/*/*.css=max-age=3600"
+	tests := []struct {
+		name   string
+		env    map[string]string
+		target string
+		want   string
+	}{
+		{"js rule", map[string]string{"CACHE_CONTROL_RULES": rules}, "/assets/app.js", "max-age=31536000, immutable"},
+		{"html rule", map[string]string{"CACHE_CONTROL_RULES": rules}, "/index.html", "no-cache"},
+		{"path rule", map[string]string{"CACHE_CONTROL_RULES": rules}, "/static/v1/site.css", "max-age=3600"},
+		{"global fallback", map[string]string{"CACHE_CONTROL_RULES": rules, "HTTP_CACHE_CONTROL": "max-age=60"}, "/photo.jpg", "max-age=60"},
+		{"rule over global", map[string]string{"CACHE_CONTROL_RULES": rules, "HTTP_CACHE_CONTROL": "max-age=60"}, "/index.html", "no-cache"},
+		{"object fallback", map[string]string{"CACHE_CONTROL_RULES": rules}, "/photo.jpg", "private"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, test.env)
+			for _, key := range []string{"assets/app.js", "index.html", "static/v1/site.css", "photo.jpg"} {
+				fake.put("bucket/"+key, fakeObject{body: "x", cacheControl: "private"})
+			}
+
+			w := serve(newRequest("GET", test.target))
+			if got := w.Header().Get("Cache-Control"); got != test.want {
+				t.Errorf("Cache-Control = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	html := strings.Repeat("<p>hello</p>", 200)
+	tests := []struct {
+		name   string
+		env    map[string]string
+		method string
+		key    string
+		header []string
+		status int
+		length string
+	}{
+		{"full", nil, "GET", "/page.html", nil, http.StatusOK, "2400"},
+		{"head", nil, "HEAD", "/page.html", nil, http.StatusOK, "2400"},
+		{"empty", nil, "GET", "/empty.txt", nil, http.StatusOK, "0"},
+		{"range", nil, "GET", "/page.html", []string{"Range", "bytes=0-99"}, http.StatusPartialContent, "100"},
+		{"suffix range", nil, "GET", "/page.html", []string{"Range", "bytes=-10"}, http.StatusPartialContent, "10"},
+		{"gzip", map[string]string{"GZIP_ENABLED": "true"}, "GET", "/page.html", []string{"Accept-Encoding", "gzip"}, http.StatusOK, ""},
+		{"gzip not accepted", map[string]string{"GZIP_ENABLED": "true"}, "GET", "/page.html", nil, http.StatusOK, "2400"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, test.env)
+			fake.put("bucket/page.html", fakeObject{body: html, contentType: "text/html"})
+			fake.put("bucket/empty.txt", fakeObject{contentType: "text/plain"})
+
+			w := serve(newRequest(test.method, test.key, test.header...))
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			got, set := w.Header()["Content-Length"]
+			if len(test.length) == 0 {
+				if set {
+					t.Errorf("Content-Length = %q, want none", got)
+				}
+				return
+			}
+			if w.Header().Get("Content-Length") != test.length {
+				t.Errorf("Content-Length = %q, want %s", got, test.length)
+			}
+			if test.method == "GET" && strconv.Itoa(w.Body.Len()) != test.length {
+				t.Errorf("wrote %d bytes, Content-Length %s", w.Body.Len(), test.length)
+			}
+		})
+	}
+}
+
+func TestRangeCache(t *testing.T) {
+	body := strings.Repeat("0123456789", 100)
+	tests := []struct {
+		name   string
+		ranges []string
+		gets   []string // ranges requested from S3
+	}{
+		{"head hit", []string{"bytes=0-9", "bytes=10-19"}, []string{"bytes=0-99"}},
+		{"window end", []string{"bytes=0-9", "bytes=90-99"}, []string{"bytes=0-99"}},
+		{"beyond window", []string{"bytes=500-599"}, []string{"bytes=500-599"}},
+		{"across window", []string{"bytes=50-150"}, []string{"bytes=50-150"}},
+		{"open ended", []string{"bytes=10-"}, []string{"bytes=10-"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"RANGE_CACHE_BYTES": "100"})
+			fake.put("bucket/video.mp4", fakeObject{body: body, contentType: "video/mp4"})
+
+			for _, spec := range test.ranges {
+				w := serve(newRequest("GET", "/video.mp4", "Range", spec))
+				start, end, _ := parseRange(spec, int64(len(body)))
+				if w.Code != http.StatusPartialContent || w.Body.String() != body[start:end+1] {
+					t.Errorf("%s: got %d %q", spec, w.Code, w.Body.String())
+				}
+				want := fmt.Sprintf("bytes %d-%d/%d", start, end, len(body))
+				if got := w.Header().Get("Content-Range"); got != want {
+					t.Errorf("%s: Content-Range = %q, want %q", spec, got, want)
+				}
+			}
+			gets := []string{}
+			for _, in := range fake.gets {
+				gets = append(gets, aws.StringValue(in.Range))
+			}
+			if !reflect.DeepEqual(gets, test.gets) {
+				t.Errorf("S3 ranges = %q, want %q", gets, test.gets)
+			}
+		})
+	}
+}
+
+func TestParallelDownload(t *testing.T) {
+	body := strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 30)
+	parallel := map[string]string{
+		"PARALLEL_DOWNLOAD_PARTS":      "4",
+		"PARALLEL_DOWNLOAD_PART_BYTES": "100",
+		"PARALLEL_DOWNLOAD_THRESHOLD":  "250",
+	}
+	fake := setup(t, nil)
+	fake.put("bucket/large.bin", fakeObject{body: body})
+	baseline := serve(newRequest("GET", "/large.bin"))
+
+	tests := []struct {
+		name      string
+		partBytes string
+		body      string
+		parts     int // ranged reads after the initial request
+	}{
+		{"large", "100", body, 10},
+		{"small", "100", body[:250], 0},
+		{"single part", "100", body[:100], 0},
+		{"partial last part", "100", body[:301], 3},
+		{"above the threshold, within a part", "500", body[:300], 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{}
+			for key, value := range parallel {
+				env[key] = value
+			}
+			env["PARALLEL_DOWNLOAD_PART_BYTES"] = test.partBytes
+			fake := setup(t, env)
+			fake.put("bucket/large.bin", fakeObject{body: test.body})
+
+			w := serve(newRequest("GET", "/large.bin"))
+			if w.Code != http.StatusOK || w.Body.String() != test.body {
+				t.Fatalf("got %d with %d bytes, want %d bytes", w.Code, w.Body.Len(), len(test.body))
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(test.body)) {
+				t.Errorf("Content-Length = %q, want %d", got, len(test.body))
+			}
+			if n := fake.count("HeadObject"); n != 0 {
+				t.Errorf("%d HeadObject calls, want none", n)
+			}
+			if len(fake.gets) != test.parts+1 || fake.gets[0].Range != nil {
+				t.Fatalf("%d GetObject calls, want an unranged one and %d parts", len(fake.gets), test.parts)
+			}
+			// Parts are requested concurrently, so in no particular order
+			got, want := []string{}, []string{}
+			for i, in := range fake.gets[1:] {
+				if in.IfMatch == nil {
+					t.Errorf("%s without If-Match", aws.StringValue(in.Range))
+				}
+				got = append(got, aws.StringValue(in.Range))
+				start := (i + 1) * 100
+				end := start + 99
+				if end >= len(test.body) {
+					end = len(test.body) - 1
+				}
+				want = append(want, fmt.Sprintf("bytes=%d-%d", start, end))
+			}
+			sort.Slice(got, func(i, j int) bool { return len(got[i]) < len(got[j]) || len(got[i]) == len(got[j]) && got[i] < got[j] })
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("parts %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("baseline", func(t *testing.T) {
+		fake := setup(t, parallel)
+		fake.put("bucket/large.bin", fakeObject{body: body})
+		w := serve(newRequest("GET", "/large.bin"))
+		if !bytes.Equal(w.Body.Bytes(), baseline.Body.Bytes()) {
+			t.Error("parallel download differs from a single GET")
+		}
+		for _, name := range []string{"Content-Length", "Content-Type", "ETag", "Last-Modified"} {
+			if got, want := w.Header().Get(name), baseline.Header().Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+	})
+
+	t.Run("cache first", func(t *testing.T) {
+		env := map[string]string{"CACHE_MAX_BYTES": "10000", "CACHE_MAX_OBJECT_BYTES": "10000"}
+		for key, value := range parallel {
+			env[key] = value
+		}
+		fake := setup(t, env)
+		fake.put("bucket/large.bin", fakeObject{body: body})
+		serve(newRequest("GET", "/large.bin"))
+		calls := len(fake.calls)
+
+		w := serve(newRequest("GET", "/large.bin"))
+		if w.Body.String() != body {
+			t.Fatalf("cached body differs, %d bytes", w.Body.Len())
+		}
+		if len(fake.calls) != calls {
+			t.Errorf("cache hit made S3 calls %q", fake.calls[calls:])
+		}
+	})
+
+	// A whole object above the threshold must still fill the caches
+	t.Run("cache, single part", func(t *testing.T) {
+		dir := t.TempDir()
+		env := map[string]string{
+			"CACHE_MAX_BYTES":              "10000",
+			"CACHE_MAX_OBJECT_BYTES":       "10000",
+			"DISK_CACHE_DIR":               dir,
+			"PARALLEL_DOWNLOAD_PART_BYTES": "500",
+		}
+		for key, value := range parallel {
+			if _, set := env[key]; !set {
+				env[key] = value
+			}
+		}
+		fake := setup(t, env)
+		fake.put("bucket/large.bin", fakeObject{body: body[:300]})
+		for i := 0; i < 2; i++ {
+			if w := serve(newRequest("GET", "/large.bin")); w.Code != http.StatusOK || w.Body.String() != body[:300] {
+				t.Fatalf("request %d: got %d with %d bytes", i, w.Code, w.Body.Len())
+			}
+		}
+		if n := fake.count("GetObject"); n != 1 {
+			t.Errorf("%d GetObject calls, want 1", n)
+		}
+	})
+}
+
+func TestS3Accelerate(t *testing.T) {
+	for _, accelerate := range []bool{false, true} {
+		t.Run(strconv.FormatBool(accelerate), func(t *testing.T) {
+			setup(t, map[string]string{"S3_ACCELERATE": strconv.FormatBool(accelerate)})
+			client := realS3(t)
+			if got := aws.BoolValue(client.Config.S3UseAccelerate); got != accelerate {
+				t.Errorf("S3UseAccelerate = %v, want %v", got, accelerate)
+			}
+		})
+	}
+
+	out := configFails(t, map[string]string{"S3_ACCELERATE": "true", "S3_ENDPOINT": "http://localhost:9000"})
+	if !strings.Contains(out, "S3_ACCELERATE can't be used with a custom S3_ENDPOINT") {
+		t.Errorf("unexpected error: %s", out)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	defer func(v, d string) { version, date = v, d }(version, date)
+	version, date = "1.2.3", "2020-01-02T03:04:05Z"
+	setup(t, nil)
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"text", "", "text/plain; charset=utf-8", "version: 1.2.3 (built at 2020-01-02T03:04:05Z)"},
+		{"html", "text/html", "text/plain; charset=utf-8", "version: 1.2.3 (built at 2020-01-02T03:04:05Z)"},
+		{"json", "application/json", "application/json",
+			`{"version":"1.2.3","built_at":"2020-01-02T03:04:05Z","go_version":"` + runtime.Version() + `"}` + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newServeMux().ServeHTTP(w, newRequest("GET", "/--version", "Accept", test.accept))
+			if w.Code != http.StatusOK || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want %q", w.Code, w.Body.String(), test.body)
+			}
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, test.contentType)
+			}
+		})
+	}
+}
+
+func TestProbes(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		err    error
+		status int
+		heads  int
+	}{
+		{"health", "/--health", nil, http.StatusOK, 0},
+		{"health, S3 down", "/--health", s3Error("ServiceUnavailable", 503), http.StatusOK, 0},
+		{"ready", "/--ready", nil, http.StatusOK, 1},
+		{"ready, S3 down", "/--ready", s3Error("ServiceUnavailable", 503), http.StatusServiceUnavailable, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"BASIC_AUTH_USER": "user", "BASIC_AUTH_PASS": "pass", "ACCESS_LOG": "true"})
+			if test.err != nil {
+				fake.errors["bucket"] = test.err
+			}
+			logs := captureLog(t, accessLogger)
+
+			w := httptest.NewRecorder()
+			newServeMux().ServeHTTP(w, newRequest("GET", test.path))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if n := fake.count("HeadBucket"); n != test.heads {
+				t.Errorf("%d HeadBucket calls, want %d", n, test.heads)
+			}
+			if logs.Len() > 0 {
+				t.Errorf("probe was logged: %s", logs)
+			}
+		})
+	}
+}
+
+// useAccessLog points the access loggers at a file for the rest of the test.
+func useAccessLog(t *testing.T, path string) {
+	t.Helper()
+	if err := openAccessLog(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		accessLogger.SetOutput(os.Stderr)
+		jsonLogger.SetOutput(os.Stderr)
+		accessLogFile.Close()
+		accessLogFile = nil
+	})
+}
+
+func TestAccessLogFile(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			// Earlier contents are appended to, never truncated
+			if err := ioutil.WriteFile(path, []byte("earlier\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			fake := setup(t, map[string]string{"ACCESS_LOG": "true", "ACCESS_LOG_FORMAT": format, "ACCESS_LOG_FILE": path})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			useAccessLog(t, path)
+
+			serve(newRequest("GET", "/file.txt"))
+			log.Print("application message")
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(lines) != 2 || lines[0] != "earlier" || !strings.Contains(lines[1], "/file.txt") {
+				t.Errorf("access log:\n%s", data)
+			}
+		})
+	}
+
+	out := configFails(t, map[string]string{"ACCESS_LOG_FILE": "/tmp/access.log"})
+	if !strings.Contains(out, "ACCESS_LOG_FILE requires ACCESS_LOG=true") {
+		t.Errorf("unexpected error: %s", out)
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	fake := setup(t, map[string]string{"ACCESS_LOG": "true", "ACCESS_LOG_FILE": path})
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+	useAccessLog(t, path)
+
+	sig := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		reopenOnSignal(sig, path)
+		close(done)
+	}()
+
+	// Requests keep being logged while the file is rotated under them
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				serve(newRequest("GET", "/file.txt"))
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	sig <- syscall.SIGHUP
+	close(sig)
+	<-done
+	wg.Wait()
+	serve(newRequest("GET", "/file.txt?after"))
+
+	count := func(name string) int {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "/file.txt")
+	}
+	rotated, current := count(path+".1"), count(path)
+	if rotated+current != 201 {
+		t.Errorf("%d lines in the rotated file and %d in the new one, want 201 in all", rotated, current)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(data), "/file.txt?after") {
+		t.Errorf("request after the rotation not in the new file:\n%s", data)
+	}
+}
+
+// discardWriter is a ResponseWriter that throws the body away, without
+// the ReadFrom method that would let io.CopyBuffer skip the buffer.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardWriter) WriteHeader(status int)      {}
+
+func TestCopyBufferBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 32 << 10},
+		{"4096", 4 << 10},
+		{"1048576", 1 << 20},
+		{"16777216", 16 << 20},
+		{"1024", 32 << 10},
+		{"1073741824", 32 << 10},
+		{"-1", 32 << 10},
+		{"lots", 32 << 10},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			setup(t, map[string]string{"COPY_BUFFER_BYTES": test.value})
+			if c.copyBufferBytes != test.want {
+				t.Errorf("copyBufferBytes = %d, want %d", c.copyBufferBytes, test.want)
+			}
+			if buf := buffers.Get().(*[]byte); len(*buf) != test.want {
+				t.Errorf("pooled buffer of %d bytes, want %d", len(*buf), test.want)
+			}
+		})
+	}
+}
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	body := strings.Repeat("0123456789abcdef", 256<<10)
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			fake := setup(b, map[string]string{"COPY_BUFFER_BYTES": strconv.Itoa(size)})
+			fake.put("bucket/large.bin", fakeObject{body: body})
+			handler := wrapper(awss3)
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.ServeHTTP(discardWriter{http.Header{}}, newRequest("GET", "/large.bin"))
+			}
+		})
+	}
+}
+
+func TestCopyBodyReuse(t *testing.T) {
+	setup(t, map[string]string{"COPY_BUFFER_BYTES": "4096"})
+	for _, body := range []string{strings.Repeat("secret", 1000), "hi", ""} {
+		var out bytes.Buffer
+		n, err := copyBody(&out, struct{ io.Reader }{strings.NewReader(body)})
+		if err != nil || n != int64(len(body)) || out.String() != body {
+			t.Errorf("copied %d bytes %.20q (%v), want %.20q", n, out.String(), err, body)
+		}
+	}
+}
+
+func BenchmarkCopyBody(b *testing.B) {
+	setup(b, nil)
+	body := strings.Repeat("x", 64<<10)
+	dst := discardWriter{http.Header{}}
+	copies := []struct {
+		name string
+		copy func(dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{"pooled", copyBody},
+		{"fresh", func(dst io.Writer, src io.Reader) (int64, error) {
+			return io.CopyBuffer(dst, src, make([]byte, c.copyBufferBytes))
+		}},
+	}
+	for _, test := range copies {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.RunParallel(func(pb *testing.PB) {
+				src := strings.NewReader(body)
+				for pb.Next() {
+					src.Reset(body)
+					// Hide WriteTo, which would bypass the buffer
+					test.copy(dst, struct{ io.Reader }{src})
+				}
+			})
+		})
+	}
+}
+
+func TestKeyPrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes string
+		target   string
+		status   int
+		body     string
+	}{
+		{"single", "/v2", "/app.js", http.StatusOK, "v2"},
+		{"first", "/v2,/legacy", "/app.js", http.StatusOK, "v2"},
+		{"second", "/v2,/legacy", "/old.js", http.StatusOK, "legacy"},
+		{"spaces", " /v2 , /legacy ", "/old.js", http.StatusOK, "legacy"},
+		{"root last", "/v2,", "/root.js", http.StatusOK, "root"},
+		{"missing everywhere", "/v2,/legacy", "/none.js", http.StatusNotFound, "Not Found\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"AWS_S3_KEY_PREFIX": test.prefixes})
+			fake.put("bucket/v2/app.js", fakeObject{body: "v2"})
+			fake.put("bucket/legacy/app.js", fakeObject{body: "legacy"})
+			fake.put("bucket/legacy/old.js", fakeObject{body: "legacy"})
+			fake.put("bucket/root.js", fakeObject{body: "root"})
+
+			w := serve(newRequest("GET", test.target))
+			if w.Code != test.status || w.Body.String() != test.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), test.status, test.body)
+			}
+		})
+	}
+}
+
+func TestSyntheticETag(t *testing.T) {
+	synthetic := fmt.Sprintf(`"%x-%x"`, lastModified.Unix(), 5)
+	tests := []struct {
+		name        string
+		enabled     string
+		header      []string
+		status      int
+		etag        string
+		ifNoneMatch bool // whether If-None-Match reaches S3
+	}{
+		{"native", "false", nil, http.StatusOK, `"native-2"`, false},
+		{"native, forwarded", "false", []string{"If-None-Match", `"native-2"`}, http.StatusNotModified, "", true},
+		{"synthetic", "true", nil, http.StatusOK, synthetic, false},
+		{"synthetic match", "true", []string{"If-None-Match", synthetic}, http.StatusNotModified, synthetic, false},
+		{"weak match", "true", []string{"If-None-Match", "W/" + synthetic}, http.StatusNotModified, synthetic, false},
+		{"synthetic mismatch", "true", []string{"If-None-Match", `"native-2"`}, http.StatusOK, synthetic, false},
+		{"ranged", "true", []string{"Range", "bytes=0-1"}, http.StatusPartialContent, synthetic, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"SYNTHETIC_ETAG": test.enabled})
+			fake.put("bucket/file.txt", fakeObject{body: "hello", etag: `"native-2"`})
+
+			w := serve(newRequest("GET", "/file.txt", test.header...))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("ETag"); got != test.etag {
+				t.Errorf("ETag = %q, want %q", got, test.etag)
+			}
+			if forwarded := fake.gets[0].IfNoneMatch != nil; forwarded != test.ifNoneMatch {
+				t.Errorf("If-None-Match forwarded = %v, want %v", forwarded, test.ifNoneMatch)
+			}
+		})
+	}
+}
+
+func TestMetadataHeaders(t *testing.T) {
+	// The SDK capitalizes metadata keys as S3 returns them
+	metadata := map[string]*string{
+		"Build-Id": aws.String("1234"),
+		"Owner":    aws.String("team"),
+	}
+	tests := []struct {
+		name   string
+		expose string
+		want   map[string]string
+	}{
+		{"none", "", map[string]string{"X-Amz-Meta-Build-Id": "", "X-Amz-Meta-Owner": ""}},
+		{"listed", "build-id", map[string]string{"X-Amz-Meta-Build-Id": "1234", "X-Amz-Meta-Owner": ""}},
+		{"both", "Build-Id, owner", map[string]string{"X-Amz-Meta-Build-Id": "1234", "X-Amz-Meta-Owner": "team"}},
+		{"absent key", "missing", map[string]string{"X-Amz-Meta-Missing": "", "X-Amz-Meta-Owner": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"EXPOSE_METADATA_HEADERS": test.expose})
+			fake.put("bucket/file.txt", fakeObject{body: "hello", metadata: metadata})
+
+			w := serve(newRequest("GET", "/file.txt"))
+			for name, want := range test.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyObject(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		method string
+		gets   int
+	}{
+		{"get", nil, "GET", 2},
+		{"head", nil, "HEAD", 0},
+		{"cached", map[string]string{"CACHE_MAX_BYTES": "1024", "CACHE_MAX_OBJECT_BYTES": "1024"}, "GET", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, test.env)
+			fake.put("bucket/empty.txt", fakeObject{contentType: "text/plain"})
+
+			// Twice, so that the second one is a cache hit when caching
+			for i := 0; i < 2; i++ {
+				w := serve(newRequest(test.method, "/empty.txt"))
+				if w.Code != http.StatusOK || w.Body.Len() != 0 {
+					t.Errorf("got %d with %d bytes, want 200 and none", w.Code, w.Body.Len())
+				}
+				if got, set := w.Header()["Content-Length"]; !set || got[0] != "0" {
+					t.Errorf("Content-Length = %q, want 0", got)
+				}
+			}
+			if n := fake.count("GetObject"); n != test.gets {
+				t.Errorf("%d GetObject calls, want %d", n, test.gets)
+			}
+		})
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	rules := `[
+		{"from": "/old.html", "to": "/new.html"},
+		{"from": "/blog/*", "to": "https://blog.example.com/*", "status": 302},
+		{"from": "/docs/*", "to": "/manual/", "status": 308}
+	]`
+	path := filepath.Join(t.TempDir(), "redirects.json")
+	if err := ioutil.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target   string
+		status   int
+		location string
+	}{
+		{"/old.html", http.StatusMovedPermanently, "/new.html"},
+		{"/old.html?ref=1", http.StatusMovedPermanently, "/new.html?ref=1"},
+		{"/blog/2020/post", http.StatusFound, "https://blog.example.com/2020/post"},
+		{"/docs/intro", http.StatusPermanentRedirect, "/manual/"},
+		{"/old.htm", http.StatusOK, ""},
+		{"/new.html", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			fake := setup(t, map[string]string{"REDIRECTS_FILE": path})
+			fake.put("bucket/old.htm", fakeObject{body: "old"})
+			fake.put("bucket/new.html", fakeObject{body: "new"})
+			var err error
+			if redirects, err = loadRedirects(c.redirectsFile); err != nil {
+				t.Fatal(err)
+			}
+
+			w := serve(newRequest("GET", test.target))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("Location"); got != test.location {
+				t.Errorf("Location = %q, want %q", got, test.location)
+			}
+			// Redirects are answered without asking S3
+			if calls := len(fake.calls); (calls == 0) != (len(test.location) > 0) {
+				t.Errorf("S3 calls %q", fake.calls)
+			}
+		})
+	}
+}
+
+func TestLoadRedirects(t *testing.T) {
+	fake := setup(t, nil)
+	fake.put("config/redirects.json", fakeObject{body: `[{"from": "/a", "to": "/b", "status": 307}]`})
+	rules, err := loadRedirects("s3://config/redirects.json")
+	if err != nil || !reflect.DeepEqual(rules, []redirectRule{{From: "/a", To: "/b", Status: 307}}) {
+		t.Errorf("loaded %v, %v", rules, err)
+	}
+
+	tests := []struct {
+		location string
+		err      string
+	}{
+		{"s3://config/missing.json", "NoSuchKey"},
+		{"s3://config", "invalid S3 location"},
+		{"s3://config/bad.json", "rule 0: from must be a path"},
+		{"s3://config/status.json", "rule 0: unsupported status 200"},
+	}
+	fake.put("config/bad.json", fakeObject{body: `[{"from": "a", "to": "/b"}]`})
+	fake.put("config/status.json", fakeObject{body: `[{"from": "/a", "to": "/b", "status": 200}]`})
+	for _, test := range tests {
+		if _, err := loadRedirects(test.location); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.location, err, test.err)
+		}
+	}
+}
+
+func TestConfigDump(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(ioutil.Discard)
+	setup(t, map[string]string{
+		"BASIC_AUTH_USERS": "alice:alicepass",
+		"BASIC_AUTH_USER":  "bob",
+		"BASIC_AUTH_PASS":  "bobpass",
+		"SSE_C_KEY":        "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		"S3_TIMEOUT":       "5",
+		"REWRITE_RULES":    `^/old/(.*)$ /new/$1`,
+	})
+
+	var line string
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, "Effective configuration: ") {
+			line = l[strings.Index(l, "{"):]
+		}
+	}
+	dump := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &dump); err != nil {
+		t.Fatalf("no configuration dump in %q: %v", logs.String(), err)
+	}
+	for key, want := range map[string]interface{}{
+		"s3Bucket":       "bucket",
+		"basicAuthUser":  "bob",
+		"basicAuthPass":  "[redacted]",
+		"sseCustomerKey": "[redacted]",
+		"s3Timeout":      "5s",
+	} {
+		if got := dump[key]; got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+	users := map[string]interface{}{"alice": "[redacted]", "bob": "[redacted]"}
+	if got := dump["basicAuthUsers"]; !reflect.DeepEqual(got, users) {
+		t.Errorf("basicAuthUsers = %v, want %v", got, users)
+	}
+	for _, secret := range []string{"alicepass", "bobpass", "0123456789abcdef", "MDEyMzQ1Njc4OWFi"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("%q was logged", secret)
+		}
+	}
+	rules := []interface{}{map[string]interface{}{"pattern": "^/old/(.*)$", "replacement": "/new/$1"}}
+	if got := dump["rewriteRules"]; !reflect.DeepEqual(got, rules) {
+		t.Errorf("rewriteRules = %v, want %v", got, rules)
+	}
+	if len(dump) != reflect.TypeOf(config{}).NumField() {
+		t.Errorf("%d keys dumped, want one per config field", len(dump))
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		problem string
+	}{
+		{map[string]string{"SSL_CERT_PATH": "cert.pem"}, "SSL_CERT_PATH and SSL_KEY_PATH must be set together"},
+		{map[string]string{"SSL_KEY_PATH": "key.pem"}, "SSL_CERT_PATH and SSL_KEY_PATH must be set together"},
+		{map[string]string{"HTTP_REDIRECT_PORT": "8080"}, "HTTP_REDIRECT_PORT requires SSL_CERT_PATH and SSL_KEY_PATH"},
+		{map[string]string{"HTTP_REDIRECT_PORT": "8443", "APP_PORT": "8443", "SSL_CERT_PATH": "cert.pem", "SSL_KEY_PATH": "key.pem"}, "HTTP_REDIRECT_PORT must differ from APP_PORT"},
+		{map[string]string{"BASIC_AUTH_USER": "user"}, "BASIC_AUTH_USER and BASIC_AUTH_PASS must be set together"},
+		{map[string]string{"BASIC_AUTH_PASS": "pass"}, "BASIC_AUTH_USER and BASIC_AUTH_PASS must be set together"},
+		{map[string]string{"AWS_ROLE_SESSION_NAME": "proxy"}, "AWS_ROLE_SESSION_NAME requires AWS_ROLE_ARN"},
+		{map[string]string{"S3_ACCELERATE": "true", "S3_ENDPOINT": "http://localhost:9000"}, "S3_ACCELERATE can't be used with a custom S3_ENDPOINT"},
+		{map[string]string{"ACCESS_LOG_FILE": "access.log"}, "ACCESS_LOG_FILE requires ACCESS_LOG=true"},
+		{map[string]string{"CACHE_MAX_BYTES": "1024", "CACHE_MAX_OBJECT_BYTES": "2048"}, "CACHE_MAX_OBJECT_BYTES can't exceed CACHE_MAX_BYTES"},
+		{map[string]string{"RANGE_CACHE_BYTES": "2048", "RANGE_CACHE_MAX_BYTES": "1024"}, "RANGE_CACHE_BYTES can't exceed RANGE_CACHE_MAX_BYTES"},
+	}
+	for _, test := range tests {
+		t.Run(test.problem, func(t *testing.T) {
+			if out := configFails(t, test.env); !strings.Contains(out, test.problem) {
+				t.Errorf("%v: unexpected error: %s", test.env, out)
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	out := configFails(t, map[string]string{"BASIC_AUTH_USER": "user", "AWS_ROLE_SESSION_NAME": "proxy"})
+	if !strings.Contains(out, "BASIC_AUTH_USER and BASIC_AUTH_PASS must be set together; AWS_ROLE_SESSION_NAME requires AWS_ROLE_ARN") {
+		t.Errorf("unexpected error: %s", out)
+	}
+}
+
+func TestCacheMaxObjectDefault(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		maxObject int64
+	}{
+		{"default", nil, 1 << 20},
+		{"large cache", map[string]string{"CACHE_MAX_BYTES": "67108864"}, 1 << 20},
+		{"small cache", map[string]string{"CACHE_MAX_BYTES": "1024"}, 1024},
+		{"explicit", map[string]string{"CACHE_MAX_BYTES": "1024", "CACHE_MAX_OBJECT_BYTES": "512"}, 512},
+		{"explicit, equal", map[string]string{"CACHE_MAX_BYTES": "1024", "CACHE_MAX_OBJECT_BYTES": "1024"}, 1024},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t, test.env)
+			if c.cacheMaxObject != test.maxObject {
+				t.Errorf("cacheMaxObject = %d, want %d", c.cacheMaxObject, test.maxObject)
+			}
+		})
+	}
+}
+
+// withConfigFile writes a config file and unsets, once the test is over,
+// the variables loading it may set.
+func withConfigFile(t *testing.T, name, contents string, keys ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, set := os.LookupEnv(key); !set {
+			key := key
+			t.Cleanup(func() { os.Unsetenv(key) })
+		}
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+	}{
+		{"yaml", "config.yaml", "AWS_S3_BUCKET: file-bucket\nAPP_PORT: 9000\nGZIP_ENABLED: true\nHTTP_CACHE_CONTROL: max-age=60\n"},
+		{"json", "config.json", `{"AWS_S3_BUCKET": "file-bucket", "APP_PORT": 9000, "GZIP_ENABLED": true, "HTTP_CACHE_CONTROL": "max-age=60"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := withConfigFile(t, test.file, test.contents, "APP_PORT", "GZIP_ENABLED", "HTTP_CACHE_CONTROL")
+			// setup sets AWS_S3_BUCKET, which wins over the file
+			setup(t, map[string]string{"CONFIG_FILE": path, "HTTP_CACHE_CONTROL": "no-cache"})
+			if c.s3Bucket != "bucket" {
+				t.Errorf("s3Bucket = %q, want the environment's", c.s3Bucket)
+			}
+			if c.httpCacheControl != "no-cache" {
+				t.Errorf("httpCacheControl = %q, want the environment's", c.httpCacheControl)
+			}
+			if c.port != "9000" || !c.gzipEnabled {
+				t.Errorf("port %q, gzip %v: file values weren't loaded", c.port, c.gzipEnabled)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for contents, problem := range map[string]string{
+			"AWS_S3_BUCKET: [a, b]\n": "AWS_S3_BUCKET: only scalar values are supported",
+			"{not yaml":               "CONFIG_FILE: yaml:",
+		} {
+			path := withConfigFile(t, "config.yaml", contents)
+			if out := configFails(t, map[string]string{"CONFIG_FILE": path}); !strings.Contains(out, problem) {
+				t.Errorf("%q: unexpected error: %s", contents, out)
+			}
+		}
+		if out := configFails(t, map[string]string{"CONFIG_FILE": "/nonexistent.yaml"}); !strings.Contains(out, "no such file") {
+			t.Errorf("unexpected error: %s", out)
+		}
+	})
+}
+
+// runMain runs main in a subprocess with env added to the environment,
+// returning its exit code and what it logged.
+func runMain(t *testing.T, env map[string]string, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^$"}, args...)...)
+	cmd.Env = append(os.Environ(), "TEST_MAIN=1")
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	out, err := cmd.CombinedOutput()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+func TestValidateOnly(t *testing.T) {
+	// Only the bucket named good can be reached
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/good") {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			return
+		}
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, `<ListBucketResult><Name>good</Name><KeyCount>0</KeyCount></ListBucketResult>`)
+		}
+	}))
+	defer s3.Close()
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		code   int
+		output string
+	}{
+		{"env", map[string]string{"AWS_S3_BUCKET": "good", "VALIDATE_ONLY": "true"}, nil, 0, "[validate] good: OK"},
+		{"flag", map[string]string{"AWS_S3_BUCKET": "good"}, []string{"-validate"}, 0, "[validate] good: OK"},
+		{"denied", map[string]string{"AWS_S3_BUCKET": "bad", "VALIDATE_ONLY": "true"}, nil, 1, "[validate] bad: Forbidden"},
+		{"mapped bucket denied", map[string]string{"AWS_S3_BUCKET": "good", "BUCKET_MAP": "a.example.com=bad"}, []string{"-validate"}, 1, "[validate] bad: Forbidden"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{
+				"S3_ENDPOINT":           s3.URL,
+				"AWS_REGION":            "us-east-1",
+				"AWS_ACCESS_KEY_ID":     "AKID",
+				"AWS_SECRET_ACCESS_KEY": "SECRET",
+				// Nothing must listen, so a server that starts fails the test
+				"APP_PORT": "-1",
+			}
+			for key, value := range test.env {
+				env[key] = value
+			}
+			code, out := runMain(t, env, test.args...)
+			if code != test.code || !strings.Contains(out, test.output) {
+				t.Errorf("exit code %d, want %d, with %q in:\n%s", code, test.code, test.output, out)
+			}
+		})
+	}
+}
+
+func TestValidateAccessTimeout(t *testing.T) {
+	fake := setup(t, map[string]string{"BUCKET_MAP": "a.example.com=other", "S3_TIMEOUT": "60"})
+	var contexts []aws.Context
+	released := false
+	fake.hook = func(ctx aws.Context) error {
+		contexts = append(contexts, ctx)
+		if len(contexts) == 3 {
+			released = contexts[0].Err() != nil
+		}
+		return nil
+	}
+	if !validateAccess() {
+		t.Fatal("validateAccess() = false, want true")
+	}
+	if len(contexts) != 4 {
+		t.Fatalf("%d S3 calls, want a HeadBucket and a listing per bucket", len(contexts))
+	}
+	// Each bucket gets a timeout of its own, released once it's checked
+	if contexts[0] != contexts[1] || contexts[1] == contexts[2] {
+		t.Error("buckets share a timeout")
+	}
+	if !released {
+		t.Error("the first bucket's timeout outlived its check")
+	}
+}
+
+func TestSSECustomerKey(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	sum := md5.Sum([]byte(key))
+	tests := []struct {
+		name   string
+		env    map[string]string
+		method string
+		want   []*string
+	}{
+		{"get", map[string]string{"SSE_C_KEY": base64.StdEncoding.EncodeToString([]byte(key))}, "GET",
+			[]*string{aws.String("AES256"), aws.String(key), aws.String(base64.StdEncoding.EncodeToString(sum[:]))}},
+		{"head", map[string]string{"SSE_C_KEY": base64.StdEncoding.EncodeToString([]byte(key))}, "HEAD",
+			[]*string{aws.String("AES256"), aws.String(key), aws.String(base64.StdEncoding.EncodeToString(sum[:]))}},
+		{"without key", nil, "GET", []*string{nil, nil, nil}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, test.env)
+			fake.put("bucket/secret.txt", fakeObject{body: "hello"})
+			w := serve(newRequest(test.method, "/secret.txt"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			var got []*string
+			if test.method == "GET" {
+				in := fake.gets[0]
+				got = []*string{in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5}
+			} else {
+				in := fake.heads[0]
+				got = []*string{in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SSE-C fields = %v, want %v", aws.StringValueSlice(got), aws.StringValueSlice(test.want))
+			}
+		})
+	}
+
+	if out := configFails(t, map[string]string{"SSE_C_KEY": "c2hvcnQ="}); !strings.Contains(out, "SSE_C_KEY must be a base64 encoded 256-bit key") {
+		t.Errorf("unexpected error: %s", out)
+	}
+}
+
+// unreadBody fails the test when a request body is read.
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Error("request body was read")
+	return 0, io.EOF
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+	}{
+		{"GET", http.StatusOK},
+		{"HEAD", http.StatusOK},
+		{"POST", http.StatusMethodNotAllowed},
+		{"PUT", http.StatusMethodNotAllowed},
+		{"DELETE", http.StatusMethodNotAllowed},
+		{"PATCH", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			r := httptest.NewRequest(test.method, "/file.txt", unreadBody{t})
+
+			w := serve(r)
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if test.status != http.StatusMethodNotAllowed {
+				return
+			}
+			if got := w.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+				t.Errorf("Allow = %q", got)
+			}
+			if len(fake.calls) > 0 {
+				t.Errorf("S3 calls %q", fake.calls)
+			}
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cors    string
+		origin  string
+		allowed string
+	}{
+		{"without CORS", "", "https://a.example", ""},
+		{"without origin", "*", "", ""},
+		{"with CORS", "*", "https://a.example", "*"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"CORS_ALLOW_ORIGIN": test.cors})
+			for _, target := range []string{"/file.txt", "/missing/", "/"} {
+				w := serve(newRequest("OPTIONS", target, "Origin", test.origin))
+				if w.Code != http.StatusNoContent || w.Body.Len() > 0 {
+					t.Errorf("%s: got %d %q, want 204 without a body", target, w.Code, w.Body.String())
+				}
+				if got := w.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+					t.Errorf("%s: Allow = %q", target, got)
+				}
+				if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allowed {
+					t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", target, got, test.allowed)
+				}
+			}
+			if len(fake.calls) > 0 {
+				t.Errorf("S3 calls %q", fake.calls)
+			}
+		})
+	}
+}
+
+func TestPathTraversal(t *testing.T) {
+	tests := []struct {
+		target string
+		status int
+		key    string // fetched from S3
+	}{
+		{"/docs/guide/intro.html", http.StatusOK, "/site/docs/guide/intro.html"},
+		{"//docs//guide/intro.html", http.StatusOK, "/site/docs/guide/intro.html"},
+		{"/docs/./guide/../guide/intro.html", http.StatusOK, "/site/docs/guide/intro.html"},
+		{"/docs/../../secret.txt", http.StatusBadRequest, ""},
+		{"/../secret.txt", http.StatusBadRequest, ""},
+		{"/%2e%2e/secret.txt", http.StatusBadRequest, ""},
+		{"/docs/%2E%2E/%2E%2E/secret.txt", http.StatusBadRequest, ""},
+		{"/docs/..%2F..%2Fsecret.txt", http.StatusBadRequest, ""},
+		{"/docs/v1..2.txt", http.StatusOK, "/site/docs/v1..2.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			fake := setup(t, map[string]string{"AWS_S3_KEY_PREFIX": "/site"})
+			fake.put("bucket/site/docs/guide/intro.html", fakeObject{body: "intro"})
+			fake.put("bucket/site/docs/v1..2.txt", fakeObject{body: "v1..2"})
+			fake.put("bucket/secret.txt", fakeObject{body: "secret"})
+
+			w := serve(newRequest("GET", test.target))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if strings.Contains(w.Body.String(), "secret") {
+				t.Error("served the object outside the key prefix")
+			}
+			var keys []string
+			for _, in := range fake.gets {
+				keys = append(keys, aws.StringValue(in.Key))
+			}
+			if len(test.key) > 0 && !reflect.DeepEqual(keys, []string{test.key}) {
+				t.Errorf("fetched %q, want %q", keys, test.key)
+			}
+			if len(test.key) == 0 && len(fake.calls) > 0 {
+				t.Errorf("S3 calls %q", fake.calls)
+			}
+		})
+	}
+}
+
+func TestEncodedKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		key    string
+	}{
+		{"space", "/my%20file.pdf", "my file.pdf"},
+		{"unicode", "/%E6%97%A5%E6%9C%AC/%C3%A9t%C3%A9.txt", "日本/été.txt"},
+		{"raw unicode", "/日本/été.txt", "日本/été.txt"},
+		{"literal plus", "/c++.txt", "c++.txt"},
+		{"encoded plus", "/c%2B%2B.txt", "c++.txt"},
+		{"percent", "/100%25.txt", "100%.txt"},
+		{"query ignored", "/my%20file.pdf?v=1a2b", "my file.pdf"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/"+test.key, fakeObject{body: "found"})
+			// A space in the path must never be taken for a plus or vice versa
+			fake.put("bucket/c  .txt", fakeObject{body: "wrong"})
+			fake.put("bucket/my+file.pdf", fakeObject{body: "wrong"})
+
+			w := serve(newRequest("GET", test.target))
+			if w.Code != http.StatusOK || w.Body.String() != "found" {
+				t.Errorf("got %d %q, want the object at %q", w.Code, w.Body.String(), test.key)
+			}
+		})
+	}
+}
+
+func TestRangeNotSatisfiable(t *testing.T) {
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		status       int
+		contentRange string
+	}{
+		{"past the end", "bytes=99999999-", http.StatusRequestedRangeNotSatisfiable, "bytes */5"},
+		{"at the end", "bytes=5-9", http.StatusRequestedRangeNotSatisfiable, "bytes */5"},
+		{"overlapping the end", "bytes=3-99", http.StatusPartialContent, "bytes 3-4/5"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+
+			w := serve(newRequest("GET", "/file.txt", "Range", test.rangeHeader))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("Content-Range"); got != test.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, test.contentRange)
+			}
+		})
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name                      string
+		env                       map[string]string
+		header, read, write, idle time.Duration
+	}{
+		{"defaults", nil, 10 * time.Second, 30 * time.Second, 0, 2 * time.Minute},
+		{"configured", map[string]string{
+			"READ_HEADER_TIMEOUT": "5s",
+			"READ_TIMEOUT":        "1m",
+			"WRITE_TIMEOUT":       "1h",
+			"IDLE_TIMEOUT":        "90s",
+		}, 5 * time.Second, time.Minute, time.Hour, 90 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t, test.env)
+			srv := newServer(http.NotFoundHandler())
+			got := []time.Duration{srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout}
+			want := []time.Duration{test.header, test.read, test.write, test.idle}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("header, read, write and idle timeouts = %v, want %v", got, want)
+			}
+		})
+	}
+
+	// A client that never finishes its headers is cut off
+	setup(t, map[string]string{"READ_HEADER_TIMEOUT": "50ms"})
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config = newServer(http.NotFoundHandler())
+	srv.Start()
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("connection wasn't closed by the server: %v", err)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(strconv.FormatBool(enabled), func(t *testing.T) {
+			fake := setup(t, map[string]string{"ENABLE_H2C": strconv.FormatBool(enabled)})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			// Upgraded connections are hijacked, so closing the server
+			// doesn't wait for their handlers
+			mux := newServeMux()
+			served := make(chan struct{}, 2)
+			srv := httptest.NewUnstartedServer(nil)
+			srv.Config = newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer func() { served <- struct{}{} }()
+				mux.ServeHTTP(w, r)
+			}))
+			srv.Start()
+			defer srv.Close()
+
+			// HTTP/2 with prior knowledge, as load balancers speak it
+			client := &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			}}
+			resp, err := client.Get(srv.URL + "/file.txt")
+			if enabled {
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.ProtoMajor != 2 || string(body) != "hello" {
+					t.Errorf("got %s %q, want HTTP/2 and the object", resp.Proto, body)
+				}
+			} else if err == nil {
+				resp.Body.Close()
+				t.Errorf("HTTP/2 without TLS answered with %s", resp.Proto)
+			}
+
+			// Upgrade from HTTP/1.1
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprint(conn, "GET /file.txt HTTP/1.1\r\nHost: example.com\r\n"+
+				"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQCAAAAAAIAAAAA\r\n\r\n")
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			status, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "HTTP/1.1 200 OK"
+			if enabled {
+				want = "HTTP/1.1 101 Switching Protocols"
+			}
+			if strings.TrimSpace(status) != want {
+				t.Errorf("upgrade answered with %q, want %q", status, want)
+			}
+			if enabled {
+				for i := 0; i < cap(served); i++ {
+					select {
+					case <-served:
+					case <-time.After(5 * time.Second):
+						t.Fatal("handler still running")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCertManager(t *testing.T) {
+	setup(t, nil)
+	if newCertManager() != nil {
+		t.Error("certificate manager without ACME_DOMAINS")
+	}
+
+	dir := t.TempDir()
+	setup(t, map[string]string{"ACME_DOMAINS": "example.com, www.example.com", "ACME_CACHE_DIR": dir})
+	m := newCertManager()
+	if m == nil {
+		t.Fatal("no certificate manager")
+	}
+	if m.Cache != autocert.DirCache(dir) {
+		t.Errorf("Cache = %v, want %s", m.Cache, dir)
+	}
+	if !m.Prompt("https://acme.example/terms") {
+		t.Error("terms of service not accepted")
+	}
+	for host, allowed := range map[string]bool{"example.com": true, "www.example.com": true, "evil.example": false} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != allowed {
+			t.Errorf("%s: host policy %v, want allowed %v", host, err, allowed)
+		}
+	}
+
+	// The redirector answers challenges and redirects everything else
+	redirector := newRedirector("80", m)
+	tests := []struct {
+		target string
+		host   string
+		status int
+	}{
+		{"/.well-known/acme-challenge/token", "example.com", http.StatusNotFound},
+		{"/.well-known/acme-challenge/token", "evil.example", http.StatusForbidden},
+		{"/file.txt", "example.com", http.StatusMovedPermanently},
+	}
+	for _, test := range tests {
+		r := newRequest("GET", test.target)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		redirector.Handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s%s: status = %d, want %d", test.host, test.target, w.Code, test.status)
+		}
+	}
+	if redirector.Addr != ":80" {
+		t.Errorf("redirector listens on %q, want :80", redirector.Addr)
+	}
+
+	// Without APP_PORT and HTTP_REDIRECT_PORT the two don't collide
+	if c.port != "443" || c.httpRedirectPort != "80" {
+		t.Errorf("APP_PORT %q and HTTP_REDIRECT_PORT %q, want 443 and 80", c.port, c.httpRedirectPort)
+	}
+	if srv := newServer(newServeMux()); srv.Addr != ":443" {
+		t.Errorf("server listens on %q, want :443", srv.Addr)
+	}
+	if out := configFails(t, map[string]string{"APP_PORT": "80"}); !strings.Contains(out, "HTTP_REDIRECT_PORT must differ from APP_PORT") {
+		t.Errorf("APP_PORT=80 with ACME_DOMAINS: %s", out)
+	}
+
+	out := configFails(t, map[string]string{"SSL_CERT_PATH": "cert.pem", "SSL_KEY_PATH": "key.pem"})
+	if !strings.Contains(out, "ACME_DOMAINS supersedes SSL_CERT_PATH and SSL_KEY_PATH") {
+		t.Errorf("unexpected error: %s", out)
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		target string
+		bucket string
+		key    string
+	}{
+		{"off", map[string]string{"AWS_S3_KEY_PREFIX": "/site"}, "/file.txt", "", ""},
+		{"on", map[string]string{"DEBUG_HEADERS": "true", "AWS_S3_KEY_PREFIX": "/site"}, "/file.txt", "bucket", "/site/file.txt"},
+		{"index", map[string]string{"DEBUG_HEADERS": "true", "AWS_S3_KEY_PREFIX": "/site"}, "/docs/", "bucket", "/site/docs/index.html"},
+		{"missing", map[string]string{"DEBUG_HEADERS": "true"}, "/missing.txt", "bucket", "/missing.txt"},
+		{"path route", map[string]string{"DEBUG_HEADERS": "true", "PATH_ROUTES": "/assets=assets-bucket:/static"}, "/assets/app.js", "assets-bucket", "/static/app.js"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, test.env)
+			fake.put("bucket/site/file.txt", fakeObject{body: "hello"})
+			fake.put("bucket/site/docs/index.html", fakeObject{body: "docs"})
+			fake.put("assets-bucket/static/app.js", fakeObject{body: "app"})
+
+			w := serve(newRequest("GET", test.target))
+			if got := w.Header().Get("X-Debug-S3-Bucket"); got != test.bucket {
+				t.Errorf("X-Debug-S3-Bucket = %q, want %q", got, test.bucket)
+			}
+			if got := w.Header().Get("X-Debug-S3-Key"); got != test.key {
+				t.Errorf("X-Debug-S3-Key = %q, want %q", got, test.key)
+			}
+		})
+	}
+}
+
+func TestImmutablePaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		etag   string // sent in If-None-Match on the second request
+		status int
+		s3     int // GetObject calls for both requests
+	}{
+		{"immutable", "/assets/app.1a2b.js", `"v1"`, http.StatusNotModified, 1},
+		{"immutable weak", "/assets/app.1a2b.js", `W/"v1"`, http.StatusNotModified, 1},
+		{"immutable mismatch", "/assets/app.1a2b.js", `"v0"`, http.StatusOK, 2},
+		{"extension", "/fonts/font.woff2", `"v1"`, http.StatusNotModified, 1},
+		// S3 errors carry no headers, so its 304 comes without an ETag
+		{"mutable", "/index.html", `"v1"`, http.StatusNotModified, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"IMMUTABLE_PATHS": "/assets/*,*.woff2"})
+			for _, key := range []string{"assets/app.1a2b.js", "fonts/font.woff2", "index.html"} {
+				fake.put("bucket/"+key, fakeObject{body: "x", etag: `"v1"`})
+			}
+			serve(newRequest("GET", test.target))
+
+			w := serve(newRequest("GET", test.target, "If-None-Match", test.etag))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("ETag"); test.s3 == 1 && got != `"v1"` {
+				t.Errorf("ETag = %q", got)
+			}
+			if n := fake.count("GetObject"); n != test.s3 {
+				t.Errorf("%d GetObject calls, want %d", n, test.s3)
+			}
+		})
+	}
+}
+
+func TestDebugS3(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(strconv.FormatBool(enabled), func(t *testing.T) {
+			setup(t, map[string]string{"DEBUG_S3": strconv.FormatBool(enabled)})
+			client := realS3(t)
+			level := client.Config.LogLevel
+			if got := level.AtLeast(aws.LogDebug); got != enabled {
+				t.Errorf("debug logging = %v, want %v", got, enabled)
+			}
+			if !enabled {
+				return
+			}
+			for _, flag := range []aws.LogLevelType{aws.LogDebugWithRequestRetries, aws.LogDebugWithRequestErrors} {
+				if !level.Matches(flag) {
+					t.Errorf("log level %d lacks %d", level.Value(), flag)
+				}
+			}
+			// Object bodies would flood the log
+			if level.Matches(aws.LogDebugWithHTTPBody) {
+				t.Error("HTTP bodies are logged")
+			}
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(ioutil.Discard)
+			client.Config.Logger.Log("DEBUG: Request s3/GetObject")
+			if !strings.Contains(logs.String(), "[s3] DEBUG: Request s3/GetObject") {
+				t.Errorf("logged %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		tls      bool
+		location string
+	}{
+		{"other host", "http://example.com/a/b.html?x=1", false, "http://www.example.com/a/b.html?x=1"},
+		{"https", "https://example.com/a.html", true, "https://www.example.com/a.html"},
+		{"escaped path", "http://example.com/a%2Fb.html", false, "http://www.example.com/a%2Fb.html"},
+		{"canonical host", "http://www.example.com/a.html", false, ""},
+		{"case", "http://WWW.Example.com/a.html", false, ""},
+		{"health", "http://example.com/--health", false, ""},
+		{"version", "http://example.com/--version", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"CANONICAL_HOST": "www.example.com"})
+			fake.put("bucket/a.html", fakeObject{body: "hello"})
+			r := newRequest("GET", test.target)
+			if !test.tls {
+				r.TLS = nil
+			}
+			w := httptest.NewRecorder()
+			newServeMux().ServeHTTP(w, r)
+			if len(test.location) == 0 {
+				if w.Code != http.StatusOK {
+					t.Errorf("got %d, want 200", w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusMovedPermanently {
+				t.Errorf("got %d, want 301", w.Code)
+			}
+			if got := w.Header().Get("Location"); got != test.location {
+				t.Errorf("Location = %q, want %q", got, test.location)
+			}
+			if n := fake.count("GetObject"); n != 0 {
+				t.Errorf("%d GetObject calls before the redirect", n)
+			}
+		})
+	}
+}
+
+func TestRootResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		path     string
+		index    bool
+		status   int
+		body     string
+		location string
+	}{
+		{"redirect", map[string]string{"ROOT_REDIRECT": "https://docs.example.com"}, "/", false, http.StatusFound, "", "https://docs.example.com"},
+		{"status", map[string]string{"ROOT_STATUS": "403"}, "/", false, http.StatusForbidden, "Forbidden\n", ""},
+		{"status and message", map[string]string{"ROOT_STATUS": "404: Nothing to see here"}, "/", false, http.StatusNotFound, "Nothing to see here\n", ""},
+		{"index found", map[string]string{"ROOT_REDIRECT": "https://docs.example.com"}, "/", true, http.StatusOK, "index", ""},
+		{"not the root", map[string]string{"ROOT_STATUS": "403"}, "/docs/", false, http.StatusNotFound, "Not Found\n", ""},
+		{"unset", nil, "/", false, http.StatusNotFound, "Not Found\n", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, test.env)
+			if test.index {
+				fake.put("bucket/index.html", fakeObject{body: "index"})
+			}
+			w := serve(newRequest("GET", test.path))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if len(test.location) > 0 {
+				if got := w.Header().Get("Location"); got != test.location {
+					t.Errorf("Location = %q, want %q", got, test.location)
+				}
+				return
+			}
+			if w.Body.String() != test.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestRootResponseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"both", map[string]string{"ROOT_REDIRECT": "https://docs.example.com", "ROOT_STATUS": "403"}, "can't be used together"},
+		{"not a number", map[string]string{"ROOT_STATUS": "forbidden"}, "ROOT_STATUS"},
+		{"out of range", map[string]string{"ROOT_STATUS": "600"}, "ROOT_STATUS"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if out := configFails(t, test.env); !strings.Contains(out, test.want) {
+				t.Errorf("output %q doesn't mention %q", out, test.want)
+			}
+		})
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	rules := `^/old/(.*)\.html$ /new/$1.html; ^/blog$ /blog/index.html; ^/old/(.*)$ /fallback/$1`
+	tests := []struct {
+		name string
+		path string
+		key  string
+	}{
+		{"capture group", "/old/foo.html", "bucket/new/foo.html"},
+		{"first match wins", "/old/foo.txt", "bucket/fallback/foo.txt"},
+		{"exact", "/blog", "bucket/blog/index.html"},
+		{"no match", "/other/foo.html", "bucket/other/foo.html"},
+		{"query kept", "/old/foo.html?x=1", "bucket/new/foo.html"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"REWRITE_RULES": rules})
+			fake.put(test.key, fakeObject{body: "hello"})
+			w := serve(newRequest("GET", test.path))
+			if w.Code != http.StatusOK || w.Body.String() != "hello" {
+				t.Errorf("got %d %q, want the object at %s", w.Code, w.Body.String(), test.key)
+			}
+			if got := w.Header().Get("Location"); len(got) > 0 {
+				t.Errorf("redirected to %q", got)
+			}
+		})
+	}
+}
+
+func TestParseRewriteRules(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  int
+		err   bool
+	}{
+		{"", 0, false},
+		{"^/a$ /b", 1, false},
+		{" ^/a$ /b ; ^/c$ /d ;", 2, false},
+		{"^/a$", 0, true},
+		{"^/a$ /b /c", 0, true},
+		{"^/(a$ /b", 0, true},
+	}
+	for _, test := range tests {
+		rules, err := parseRewriteRules(test.rules)
+		if (err != nil) != test.err || len(rules) != test.want {
+			t.Errorf("parseRewriteRules(%q) = %d rules, %v; want %d rules, error %v", test.rules, len(rules), err, test.want, test.err)
+		}
+	}
+	// The pattern is kept as written for the configuration dump
+	rules, _ := parseRewriteRules(" ^/a/(.*)$  /b/$1 ")
+	if rules[0].source != "^/a/(.*)$" {
+		t.Errorf("source = %q, want ^/a/(.*)$", rules[0].source)
+	}
+}
+
+func TestQueryStringKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		key    string
+	}{
+		{"cache busting", "/app.js?v=1a2b", "app.js"},
+		{"several parameters", "/app.js?v=1a2b&x=y", "app.js"},
+		{"empty query", "/app.js?", "app.js"},
+		{"escaped question mark", "/app.js%3Fv=1a2b", "app.js?v=1a2b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, nil)
+			fake.put("bucket/app.js", fakeObject{body: "js"})
+			fake.put("bucket/app.js?v=1a2b", fakeObject{body: "other"})
+			serve(newRequest("GET", test.target))
+			if len(fake.gets) != 1 {
+				t.Fatalf("%d GetObject calls, want 1", len(fake.gets))
+			}
+			if got := strings.TrimPrefix(aws.StringValue(fake.gets[0].Key), "/"); got != test.key {
+				t.Errorf("key = %q, want %q", got, test.key)
+			}
+		})
+	}
+}
+
+func TestQueryStringCache(t *testing.T) {
+	fake := setup(t, map[string]string{"CACHE_MAX_BYTES": "1024", "CACHE_TTL": "1m"})
+	fake.put("bucket/app.js", fakeObject{body: "js"})
+	for _, target := range []string{"/app.js?v=1", "/app.js?v=2", "/app.js"} {
+		if w := serve(newRequest("GET", target)); w.Body.String() != "js" {
+			t.Errorf("%s: got %q", target, w.Body.String())
+		}
+	}
+	if n := fake.count("GetObject"); n != 1 {
+		t.Errorf("%d GetObject calls, want 1", n)
+	}
+}
+
+func TestMaxObjectBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect string
+		method   string
+		size     int
+		status   int
+	}{
+		{"within", "", "GET", 500, http.StatusOK},
+		{"at", "", "GET", 1000, http.StatusOK},
+		{"oversized", "", "GET", 1001, http.StatusRequestEntityTooLarge},
+		{"HEAD oversized", "", "HEAD", 2000, http.StatusRequestEntityTooLarge},
+		{"oversized, redirect", "true", "GET", 2000, http.StatusFound},
+		{"within, redirect", "true", "GET", 500, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"MAX_OBJECT_BYTES": "1000", "MAX_OBJECT_REDIRECT": test.redirect})
+			body := strings.Repeat("v", test.size)
+			fake.put("bucket/video.mp4", fakeObject{body: body})
+			w := serve(newRequest(test.method, "/video.mp4"))
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			switch test.status {
+			case http.StatusOK:
+				if test.method == "GET" && w.Body.String() != body {
+					t.Errorf("got %d bytes, want %d", w.Body.Len(), test.size)
+				}
+			case http.StatusFound:
+				if u := presignedURL(t, w.Header().Get("Location")); u.Path != "/video.mp4" {
+					t.Errorf("redirected to %s", u)
+				}
+			default:
+				if strings.Contains(w.Body.String(), "vvv") {
+					t.Error("oversized body was streamed")
+				}
+			}
+		})
+	}
+}
+
+func TestMaxObjectBytesVersion(t *testing.T) {
+	fake := setup(t, map[string]string{
+		"ALLOW_VERSION_ACCESS": "true",
+		"MAX_OBJECT_BYTES":     "10",
+		"MAX_OBJECT_REDIRECT":  "true",
+	})
+	fake.put("bucket/video.mp4", fakeObject{body: "latest"})
+	fake.put("bucket/video.mp4?versionId=v1", fakeObject{body: "the first version"})
+
+	w := serve(newRequest("GET", "/video.mp4?versionId=v1"))
+	if w.Code != http.StatusFound {
+		t.Fatalf("status = %d, want 302", w.Code)
+	}
+	if u := presignedURL(t, w.Header().Get("Location")); u.Query().Get("versionId") != "v1" {
+		t.Errorf("redirected to %s, want version v1", u)
+	}
+}
+
+func TestMaxObjectBytesUnlimited(t *testing.T) {
+	for _, value := range []string{"", "0", "-1"} {
+		fake := setup(t, map[string]string{"MAX_OBJECT_BYTES": value})
+		fake.put("bucket/video.mp4", fakeObject{body: strings.Repeat("v", 100000)})
+		if w := serve(newRequest("GET", "/video.mp4")); w.Code != http.StatusOK || w.Body.Len() != 100000 {
+			t.Errorf("MAX_OBJECT_BYTES=%q: got %d, %d bytes", value, w.Code, w.Body.Len())
+		}
+	}
+	if out := configFails(t, map[string]string{"MAX_OBJECT_REDIRECT": "true"}); !strings.Contains(out, "MAX_OBJECT_REDIRECT requires MAX_OBJECT_BYTES") {
+		t.Errorf("MAX_OBJECT_REDIRECT alone logged %q", out)
+	}
+}
+
+func TestSlowRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		accessLog string
+		delay     time.Duration
+		logged    bool
+	}{
+		{"fast", "false", 0, false},
+		{"slow", "false", 50 * time.Millisecond, true},
+		{"slow, access log", "true", 50 * time.Millisecond, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"SLOW_REQUEST_MS": "20", "ACCESS_LOG": test.accessLog})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			fake.hook = func(ctx aws.Context) error {
+				time.Sleep(test.delay)
+				return nil
+			}
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(ioutil.Discard)
+			captureLog(t, accessLogger)
+
+			serve(newRequest("GET", "/file.txt?x=1"))
+			line := logs.String()
+			if logged := strings.Contains(line, "[warn] slow request"); logged != test.logged {
+				t.Fatalf("logged %q, want a warning: %v", line, test.logged)
+			}
+			if test.logged && !strings.Contains(line, " 200 5 GET /file.txt?x=1 ") {
+				t.Errorf("warning %q lacks the request", line)
+			}
+		})
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		server string
+	}{
+		{"custom", "edge", "edge"},
+		{"none", "none", ""},
+		{"NONE", "NONE", ""},
+		{"empty", "", ""},
+	}
+	requests := []struct {
+		redirector bool
+		target     string
+		auth       bool
+		status     int
+	}{
+		{false, "/file.txt", true, http.StatusOK},
+		{false, "/missing.txt", true, http.StatusNotFound},
+		{false, "/file.txt", false, http.StatusUnauthorized},
+		{false, "/--version", false, http.StatusOK},
+		{false, "/healthz", false, http.StatusOK},
+		{false, "/--health", false, http.StatusOK},
+		{false, "/--ready", false, http.StatusOK},
+		{false, "/metrics", false, http.StatusOK},
+		{true, "/file.txt", false, http.StatusMovedPermanently},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{
+				"SERVER_HEADER":    test.value,
+				"BASIC_AUTH_USERS": "user:pass",
+				"METRICS_ENABLED":  "true",
+			})
+			fake.put("bucket/file.txt", fakeObject{body: "hello"})
+			server := newServer(newServeMux()).Handler
+			redirector := newRedirector("80", nil).Handler
+			for _, req := range requests {
+				w := httptest.NewRecorder()
+				// Set by something in front of the proxy
+				w.Header().Set("Server", "net/http")
+				r := newRequest("GET", req.target)
+				if req.auth {
+					r.SetBasicAuth("user", "pass")
+				}
+				if req.redirector {
+					redirector.ServeHTTP(w, r)
+				} else {
+					server.ServeHTTP(w, r)
+				}
+				if w.Code != req.status {
+					t.Errorf("%s: status = %d, want %d", req.target, w.Code, req.status)
+				}
+				if got := strings.Join(w.Header()["Server"], ", "); got != test.server {
+					t.Errorf("%s: Server = %q, want %q", req.target, got, test.server)
+				}
+			}
+		})
+	}
+}
+
+func TestCanarySplit(t *testing.T) {
+	tests := []struct {
+		percent  string
+		min, max float64
+	}{
+		{"0", 0, 0},
+		{"30", 0.25, 0.35},
+		{"50", 0.45, 0.55},
+		{"100", 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.percent, func(t *testing.T) {
+			setup(t, map[string]string{"CANARY_PREFIX": "canary", "CANARY_PERCENT": test.percent})
+			canary := 0
+			for i := 0; i < 1000; i++ {
+				r := newRequest("GET", "/file.txt")
+				r.RemoteAddr = fmt.Sprintf("10.%d.%d.1:1234", i/256, i%256)
+				in := inCanary(r)
+				if in {
+					canary++
+				}
+				// The same client always lands on the same side
+				r.RemoteAddr = fmt.Sprintf("10.%d.%d.1:5678", i/256, i%256)
+				if inCanary(r) != in {
+					t.Fatalf("%s changed sides", r.RemoteAddr)
+				}
+			}
+			if share := float64(canary) / 1000; share < test.min || share > test.max {
+				t.Errorf("%.3f of clients in the canary, want %.2f to %.2f", share, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestCanarySticky(t *testing.T) {
+	tests := []struct {
+		name    string
+		percent string
+		cookie  string
+		body    string
+		set     string // the cookie value handed out, if any
+	}{
+		{"stable", "0", "", "stable", "0"},
+		{"canary", "100", "", "canary", "1"},
+		{"pinned to the canary", "0", "1", "canary", ""},
+		{"pinned to stable", "100", "0", "stable", ""},
+		{"invalid cookie", "100", "x", "canary", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{
+				"AWS_S3_KEY_PREFIX": "stable",
+				"CANARY_PREFIX":     "canary",
+				"CANARY_PERCENT":    test.percent,
+			})
+			fake.put("bucket/stable/file.txt", fakeObject{body: "stable"})
+			fake.put("bucket/canary/file.txt", fakeObject{body: "canary"})
+			r := newRequest("GET", "/file.txt")
+			if len(test.cookie) > 0 {
+				r.AddCookie(&http.Cookie{Name: canaryCookie, Value: test.cookie})
+			}
+			w := serve(r)
+			if w.Body.String() != test.body {
+				t.Errorf("got %q, want %q", w.Body.String(), test.body)
+			}
+			cookies := (&http.Response{Header: w.Header()}).Cookies()
+			if len(test.set) == 0 {
+				if len(cookies) > 0 {
+					t.Errorf("cookie set again: %v", cookies)
+				}
+				return
+			}
+			if len(cookies) != 1 || cookies[0].Name != canaryCookie || cookies[0].Value != test.set || cookies[0].Path != "/" {
+				t.Fatalf("cookies = %v, want %s=%s", cookies, canaryCookie, test.set)
+			}
+
+			// The cookie keeps the client on its side after the split changes
+			c.canaryPercent = 100 - c.canaryPercent
+			r = newRequest("GET", "/file.txt")
+			r.AddCookie(cookies[0])
+			if w := serve(r); w.Body.String() != test.body {
+				t.Errorf("with the cookie: got %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestCanaryConfig(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"CANARY_PREFIX": "canary", "CANARY_PERCENT": "101"}, "CANARY_PERCENT must be 0 to 100"},
+		{map[string]string{"CANARY_PREFIX": "canary", "CANARY_PERCENT": "half"}, "CANARY_PERCENT must be 0 to 100"},
+		{map[string]string{"CANARY_PERCENT": "10"}, "CANARY_PERCENT requires CANARY_PREFIX"},
+	}
+	for _, test := range tests {
+		if out := configFails(t, test.env); !strings.Contains(out, test.want) {
+			t.Errorf("%v logged %q, want %q", test.env, out, test.want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_s3_proxy_requests_total",
+		Help: "Number of proxied requests by HTTP status code.",
+	}, []string{"code"})
+
+	requestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "aws_s3_proxy_request_duration_seconds",
+		Help:    "Time taken to serve proxied requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration)
+}
+
+func observe(status int, elapsed time.Duration) {
+	requestsTotal.WithLabelValues(strconv.Itoa(status)).Inc()
+	requestDuration.Observe(elapsed.Seconds())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the value of a sample on the /metrics page, or 0 when
+// it hasn't been reported yet.
+func scrape(t *testing.T, mux *http.ServeMux, sample string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, newRequest("GET", "/metrics"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics status = %d, want 200", w.Code)
+	}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		if value := strings.TrimPrefix(scanner.Text(), sample+" "); value != scanner.Text() {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", sample, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	fake := setup(t, map[string]string{
+		"METRICS_ENABLED": "true",
+		"BASIC_AUTH_USER": "user",
+		"BASIC_AUTH_PASS": "pass",
+	})
+	fake.put("bucket/file.txt", fakeObject{body: "hello"})
+	mux := newServeMux()
+
+	tests := []struct {
+		path string
+		code string
+	}{
+		{"/file.txt", "200"},
+		{"/missing.txt", "404"},
+	}
+	for _, test := range tests {
+		sample := `aws_s3_proxy_requests_total{code="` + test.code + `"}`
+		before := scrape(t, mux, sample)
+		r := newRequest("GET", test.path)
+		r.SetBasicAuth("user", "pass")
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+		if after := scrape(t, mux, sample); after != before+1 {
+			t.Errorf("%s: %s = %v, want %v", test.path, sample, after, before+1)
+		}
+	}
+	if n := fake.count("GetObject"); n != len(tests) {
+		t.Errorf("%d GetObject calls, want %d: /metrics must not be proxied", n, len(tests))
+	}
+}
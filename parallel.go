@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3getParallel fetches large objects with concurrent ranged reads.
+// s3manager.Downloader isn't used because it needs an io.WriterAt,
+// whereas the parts here have to be streamed to the client in order.
+// The object is requested as usual first, its size deciding whether the
+// remaining parts are fetched in parallel while the first one streams.
+// Objects that fit in a single part have nothing left to fetch.
+func s3getParallel(ctx context.Context, bucket, key string) (*s3.GetObjectOutput, error) {
+	obj, err := s3get(ctx, bucket, key, "", nil)
+	if err != nil || aws.Int64Value(obj.ContentLength) <= c.parallelMinSize || aws.Int64Value(obj.ContentLength) <= c.parallelPartSize {
+		return obj, err
+	}
+	obj.Body = newParallelReader(ctx, bucket, key, aws.StringValue(obj.ETag), *obj.ContentLength, obj.Body)
+	return obj, nil
+}
+
+// s3getFull fetches a whole object, in parallel parts when enabled.
+func s3getFull(ctx context.Context, bucket, key string) (*s3.GetObjectOutput, error) {
+	if c.parallelParts > 0 {
+		return s3getParallel(ctx, bucket, key)
+	}
+	return s3get(ctx, bucket, key, "", nil)
+}
+
+type partResult struct {
+	body []byte
+	err  error
+}
+
+// parallelReader streams the first part from the body of the initial
+// request and downloads the other parts ahead of the reader. At most
+// parallelParts parts are in flight or buffered at any time.
+type parallelReader struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	first   io.ReadCloser
+	rest    io.Reader // the first part of first
+	parts   []chan partResult
+	tokens  chan struct{}
+	current *bytes.Reader
+	next    int
+}
+
+func newParallelReader(ctx context.Context, bucket, key, etag string, size int64, first io.ReadCloser) *parallelReader {
+	ctx, cancel := context.WithCancel(ctx)
+	count := (size + c.parallelPartSize - 1) / c.parallelPartSize
+	pr := &parallelReader{
+		ctx:    ctx,
+		cancel: cancel,
+		first:  first,
+		rest:   io.LimitReader(first, c.parallelPartSize),
+		parts:  make([]chan partResult, count-1),
+		tokens: make(chan struct{}, c.parallelParts),
+	}
+	for i := range pr.parts {
+		pr.parts[i] = make(chan partResult, 1)
+	}
+
+	go func() {
+		for i, part := range pr.parts {
+			select {
+			case pr.tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			start := int64(i+1) * c.parallelPartSize
+			end := start + c.parallelPartSize - 1
+			if end >= size {
+				end = size - 1
+			}
+			go func(part chan partResult, start, end int64) {
+				body, err := s3getPart(ctx, bucket, key, etag, start, end)
+				part <- partResult{body, err}
+			}(part, start, end)
+		}
+	}()
+	return pr
+}
+
+// s3getPart reads a byte range, failing if the object changed meanwhile.
+func s3getPart(ctx context.Context, bucket, key, etag string, start, end int64) ([]byte, error) {
+	req := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	}
+	req.SSECustomerAlgorithm, req.SSECustomerKey, req.SSECustomerKeyMD5 = sseCustomer()
+	if len(etag) > 0 {
+		req.IfMatch = aws.String(etag)
+	}
+	obj, err := s3For(bucket).GetObjectWithContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return ioutil.ReadAll(obj.Body)
+}
+
+func (pr *parallelReader) Read(p []byte) (int, error) {
+	if pr.first != nil {
+		n, err := pr.rest.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		// The rest of the initial response is never read
+		pr.first.Close()
+		pr.first = nil
+		if pr.rest.(*io.LimitedReader).N > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	for {
+		if pr.current != nil {
+			if pr.current.Len() > 0 {
+				return pr.current.Read(p)
+			}
+			// Done with this part, let the next one start downloading
+			pr.current = nil
+			<-pr.tokens
+		}
+		if pr.next >= len(pr.parts) {
+			return 0, io.EOF
+		}
+		select {
+		case result := <-pr.parts[pr.next]:
+			pr.next++
+			if result.err != nil {
+				return 0, result.err
+			}
+			pr.current = bytes.NewReader(result.body)
+		case <-pr.ctx.Done():
+			return 0, pr.ctx.Err()
+		}
+	}
+}
+
+func (pr *parallelReader) Close() error {
+	pr.cancel()
+	if pr.first != nil {
+		pr.first.Close()
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// presign redirects the client to a presigned S3 URL for the key
+// following /--presign, so that the download bypasses the proxy.
+// The expires query parameter (seconds) may shorten the default expiry.
+func presign(w http.ResponseWriter, r *http.Request) {
+	path, valid := requestPath(r)
+	if !valid {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	bucket, keyPrefixes, path := route(r, strings.TrimPrefix(path, "/--presign"))
+	if strings.HasSuffix(path, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	expiry := c.presignExpiry
+	if secs, err := strconv.Atoi(r.URL.Query().Get("expires")); err == nil && secs > 0 {
+		if d := time.Duration(secs) * time.Second; d < expiry {
+			expiry = d
+		}
+	}
+
+	url, err := presignURL(bucket, keyPrefixes[0]+path, "", expiry)
+	if err != nil {
+		code, message := toHTTPError(err)
+		http.Error(w, message, code)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			URL     string    `json:"url"`
+			Expires time.Time `json:"expires"`
+		}{url, time.Now().Add(expiry).UTC()})
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// presignURL signs a GET of the object, or of a specific version of it
+// when versionID is set.
+func presignURL(bucket, key, versionID string, expiry time.Duration) (string, error) {
+	in := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if len(versionID) > 0 {
+		in.VersionId = aws.String(versionID)
+	}
+	req, _ := s3For(bucket).GetObjectRequest(in)
+	return req.Presign(expiry)
+}
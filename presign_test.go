@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// presignedURL checks that a presigned URL is well-formed and returns it.
+func presignedURL(t *testing.T, location string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("presigned URL %q: %v", location, err)
+	}
+	if u.Scheme != "https" || !strings.HasPrefix(u.Host, "bucket.") {
+		t.Errorf("presigned URL %q isn't on the bucket's host", location)
+	}
+	query := u.Query()
+	for _, name := range []string{"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-Signature"} {
+		if len(query.Get(name)) == 0 {
+			t.Errorf("presigned URL %q lacks %s", location, name)
+		}
+	}
+	return u
+}
+
+func TestPresign(t *testing.T) {
+	tests := []struct {
+		target  string
+		path    string
+		expires string
+	}{
+		{"/--presign/docs/file.pdf", "/docs/file.pdf", "900"},
+		{"/--presign/docs/file.pdf?expires=60", "/docs/file.pdf", "60"},
+		{"/--presign/docs/file.pdf?expires=86400", "/docs/file.pdf", "900"},
+		{"/--presign/a%20b.pdf?expires=0", "/a%20b.pdf", "900"},
+	}
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			setup(t, map[string]string{"BASIC_AUTH_USER": "user", "BASIC_AUTH_PASS": "pass", "PRESIGN_EXPIRY": "15m"})
+			r := newRequest("GET", test.target)
+			r.SetBasicAuth("user", "pass")
+			w := httptest.NewRecorder()
+			newServeMux().ServeHTTP(w, r)
+			if w.Code != http.StatusFound {
+				t.Fatalf("status = %d, want 302", w.Code)
+			}
+			u := presignedURL(t, w.Header().Get("Location"))
+			if u.EscapedPath() != test.path {
+				t.Errorf("path = %q, want %q", u.EscapedPath(), test.path)
+			}
+			if got := u.Query().Get("X-Amz-Expires"); got != test.expires {
+				t.Errorf("X-Amz-Expires = %s, want %s", got, test.expires)
+			}
+		})
+	}
+}
+
+func TestPresignJSON(t *testing.T) {
+	setup(t, map[string]string{"BASIC_AUTH_USER": "user", "BASIC_AUTH_PASS": "pass"})
+	r := newRequest("GET", "/--presign/file.txt?expires=120", "Accept", "application/json")
+	r.SetBasicAuth("user", "pass")
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, r)
+
+	var answer struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	presignedURL(t, answer.URL)
+	if d := time.Until(answer.Expires); d < 110*time.Second || d > 120*time.Second {
+		t.Errorf("expires in %v, want 2m", d)
+	}
+}
+
+func TestPresignAuth(t *testing.T) {
+	setup(t, map[string]string{"BASIC_AUTH_USER": "user", "BASIC_AUTH_PASS": "pass"})
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, newRequest("GET", "/--presign/file.txt"))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", w.Code)
+	}
+}
+
+// Without users the route isn't there, so the path goes to S3
+func TestPresignWithoutUsers(t *testing.T) {
+	fake := setup(t, nil)
+	w := httptest.NewRecorder()
+	newServeMux().ServeHTTP(w, newRequest("GET", "/--presign/file.txt"))
+	if w.Code != http.StatusNotFound || fake.count("GetObject") != 1 {
+		t.Errorf("status = %d after %v, want 404 from S3", w.Code, fake.calls)
+	}
+}
+
+func TestRedirectThreshold(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		size   int
+		status int
+	}{
+		{"above", "GET", 2000, http.StatusFound},
+		{"below", "GET", 500, http.StatusOK},
+		{"at", "GET", 1000, http.StatusOK},
+		{"HEAD above", "HEAD", 2000, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := setup(t, map[string]string{"REDIRECT_THRESHOLD_BYTES": "1000"})
+			fake.put("bucket/video.mp4", fakeObject{body: strings.Repeat("v", test.size)})
+			w := serve(newRequest(test.method, "/video.mp4"))
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			if test.status == http.StatusFound {
+				if u := presignedURL(t, w.Header().Get("Location")); u.Path != "/video.mp4" {
+					t.Errorf("redirected to %s", u)
+				}
+				if n := fake.count("GetObject"); n != 0 {
+					t.Errorf("%d GetObject calls, want none", n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// warmRange parses a single "bytes=start-end" range lying entirely in the
+// warm window at the beginning of objects. Conditional requests are skipped.
+func warmRange(h http.Header) (int64, int64, bool) {
+	for _, key := range []string{"If-Range", "If-Modified-Since", "If-None-Match"} {
+		if len(h.Get(key)) > 0 {
+			return 0, 0, false
+		}
+	}
+	spec := h.Get("Range")
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(spec, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseInt(strings.TrimSpace(bounds[1]), 10, 64)
+	if err != nil || start > end || end >= c.rangeCacheBytes {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// s3getWarmRange serves a range from the cached head of the object,
+// fetching the whole warm window from S3 on a miss. It returns a nil
+// object without an error when the range has to be fetched from S3.
+func s3getWarmRange(ctx context.Context, bucket, key string, start, end int64) (*s3.GetObjectOutput, error) {
+	cacheKey := bucket + "/" + key
+	entry, found, _ := ranges.lookup(cacheKey)
+	if !found {
+		window := http.Header{"Range": {fmt.Sprintf("bytes=0-%d", c.rangeCacheBytes-1)}}
+		obj, err := s3get(ctx, bucket, key, "", window)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		ranges.add(cacheKey, obj, body)
+		entry = &cacheEntry{obj: *obj, body: body}
+	}
+
+	total := objectSize(entry.obj.ContentRange)
+	if total < 0 || start >= total {
+		return nil, nil
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if end >= int64(len(entry.body)) {
+		return nil, nil
+	}
+	obj := entry.obj
+	obj.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	obj.ContentLength = aws.Int64(end - start + 1)
+	obj.Body = ioutil.NopCloser(bytes.NewReader(entry.body[start : end+1]))
+	return &obj, nil
+}
+
+// objectSize reads the complete length from a "bytes 0-99/1234"
+// Content-Range value. It returns -1 when the length is unknown.
+func objectSize(contentRange *string) int64 {
+	value := aws.StringValue(contentRange)
+	idx := strings.LastIndex(value, "/")
+	if idx < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(value[idx+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// redirects are loaded once at startup from REDIRECTS_FILE.
+var redirects []redirectRule
+
+// redirectRule sends requests for From to To. A From ending in * matches
+// every path with that prefix, and a trailing * in To is replaced with
+// the rest of the matched path.
+type redirectRule struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status int    `json:"status"`
+}
+
+// loadRedirects reads a JSON array of redirect rules from a local file
+// or, for locations of the form s3://bucket/key, from S3.
+func loadRedirects(location string) ([]redirectRule, error) {
+	var data []byte
+	if strings.HasPrefix(location, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid S3 location %q", location)
+		}
+		obj, err := s3get(context.Background(), parts[0], parts[1], "", nil)
+		if err != nil {
+			return nil, err
+		}
+		defer obj.Body.Close()
+		if data, err = ioutil.ReadAll(obj.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(location); err != nil {
+			return nil, err
+		}
+	}
+
+	rules := []redirectRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if !strings.HasPrefix(rule.From, "/") || len(rule.To) == 0 {
+			return nil, fmt.Errorf("rule %d: from must be a path and to must be set", i)
+		}
+		switch rule.Status {
+		case 0:
+			rules[i].Status = http.StatusMovedPermanently
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("rule %d: unsupported status %d", i, rule.Status)
+		}
+	}
+	return rules, nil
+}
+
+// findRedirect returns the target and status of the first rule matching
+// path. Exact and wildcard rules are consulted in file order.
+func findRedirect(path string) (string, int, bool) {
+	for _, rule := range redirects {
+		if rule.From == path {
+			return rule.To, rule.Status, true
+		}
+		prefix := strings.TrimSuffix(rule.From, "*")
+		if prefix != rule.From && strings.HasPrefix(path, prefix) {
+			to := rule.To
+			if strings.HasSuffix(to, "*") {
+				to = strings.TrimSuffix(to, "*") + path[len(prefix):]
+			}
+			return to, rule.Status, true
+		}
+	}
+	return "", 0, false
+}
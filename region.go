@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Buckets found to live outside AWS_REGION get a client of their own.
+var (
+	regionMu      sync.Mutex
+	regionClients = map[string]s3iface.S3API{}
+	relocations   = map[string]*relocation{} // in progress, by bucket
+)
+
+// relocation is a region lookup shared by the requests that failed
+// on the same bucket at the same time.
+type relocation struct {
+	done chan struct{}
+	ok   bool
+}
+
+// s3For returns the client to use for the bucket.
+func s3For(bucket string) s3iface.S3API {
+	regionMu.Lock()
+	defer regionMu.Unlock()
+
+	if client, found := regionClients[bucket]; found {
+		return client
+	}
+	return svc
+}
+
+// isWrongRegion reports whether S3 rejected a request because the bucket
+// lives in another region. The SDK turns every 301 into BucketRegionError,
+// body or not; requests signed for the wrong region fail with
+// AuthorizationHeaderMalformed instead.
+func isWrongRegion(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "BucketRegionError", "AuthorizationHeaderMalformed":
+			return true
+		}
+	}
+	return false
+}
+
+// relocate looks up the region of a bucket after a wrong region error,
+// and switches the bucket over to a client for that region. It reports
+// whether the failed request is worth retrying. Concurrent failures on
+// the same bucket wait for a single lookup.
+func relocate(ctx context.Context, bucket string, err error) bool {
+	if !isWrongRegion(err) {
+		return false
+	}
+	regionMu.Lock()
+	if r, found := relocations[bucket]; found {
+		regionMu.Unlock()
+		select {
+		case <-r.done:
+			return r.ok
+		case <-ctx.Done():
+			return false
+		}
+	}
+	r := &relocation{done: make(chan struct{})}
+	relocations[bucket] = r
+	regionMu.Unlock()
+
+	r.ok = switchRegion(ctx, bucket)
+
+	regionMu.Lock()
+	delete(relocations, bucket)
+	regionMu.Unlock()
+	close(r.done)
+	return r.ok
+}
+
+// switchRegion gives the bucket a client for the region S3 reports.
+func switchRegion(ctx context.Context, bucket string) bool {
+	// S3 names the region even when it refuses the request itself
+	region := ""
+	s3For(bucket).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	}, withResponseHeader("X-Amz-Bucket-Region", &region))
+	if len(region) == 0 {
+		return false
+	}
+
+	conf := *c
+	conf.awsRegion = region
+	client, err := newS3Client(&conf)
+	if err != nil {
+		log.Printf("[service] bucket %s is in %s: %v", bucket, region, err)
+		return false
+	}
+
+	regionMu.Lock()
+	regionClients[bucket] = client
+	regionMu.Unlock()
+	log.Printf("[service] bucket %s is in %s, not %s", bucket, region, c.awsRegion)
+	return true
+}
+
+// withResponseHeader is request.WithGetResponseHeader for requests that
+// may fail before getting a response, leaving val untouched then.
+func withResponseHeader(key string, val *string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(req *request.Request) {
+			if req.HTTPResponse != nil {
+				*val = req.HTTPResponse.Header.Get(key)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// regionS3 serves the bucket only to requests signed for region, and
+// redirects the others the way S3 does.
+type regionS3 struct {
+	region string
+	header bool          // whether redirects name the bucket's region
+	hold   chan struct{} // bucket lookups wait for it to close, if set
+
+	mu       sync.Mutex
+	requests []string // method, path and signing region of each request
+}
+
+func (s *regionS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	region := ""
+	if fields := strings.Split(r.Header.Get("Authorization"), "/"); len(fields) > 2 {
+		region = fields[2]
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, region))
+	s.mu.Unlock()
+
+	if r.Method == http.MethodHead && r.URL.Path == "/bucket" && s.hold != nil {
+		<-s.hold
+	}
+	if region != s.region {
+		if s.header {
+			w.Header().Set("X-Amz-Bucket-Region", s.region)
+		}
+		w.WriteHeader(http.StatusMovedPermanently)
+		if r.Method != http.MethodHead {
+			fmt.Fprint(w, `<Error><Code>PermanentRedirect</Code><Message>Use the right endpoint</Message></Error>`)
+		}
+		return
+	}
+	if r.URL.Path == "/bucket/file.txt" {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "hello")
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// count returns how many requests started with prefix.
+func (s *regionS3) count(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, r := range s.requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestIsWrongRegion(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"BucketRegionError", true},
+		{"AuthorizationHeaderMalformed", true},
+		{"AccessDenied", false},
+		{"NoSuchKey", false},
+	}
+	for _, test := range tests {
+		if got := isWrongRegion(awserr.New(test.code, "", nil)); got != test.want {
+			t.Errorf("isWrongRegion(%s) = %v, want %v", test.code, got, test.want)
+		}
+	}
+	if isWrongRegion(fmt.Errorf("BucketRegionError")) {
+		t.Error("plain errors aren't from S3")
+	}
+}
+
+func TestRegionRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		header   bool
+		status   int
+		requests []string
+	}{
+		{"GET", "GET", true, http.StatusOK, []string{
+			"GET /bucket/file.txt us-east-1",
+			"HEAD /bucket us-east-1",
+			"GET /bucket/file.txt eu-west-1",
+			"GET /bucket/file.txt eu-west-1",
+		}},
+		{"HEAD", "HEAD", true, http.StatusOK, []string{
+			"HEAD /bucket/file.txt us-east-1",
+			"HEAD /bucket us-east-1",
+			"HEAD /bucket/file.txt eu-west-1",
+			"HEAD /bucket/file.txt eu-west-1",
+		}},
+		// Without a region to go to there's nothing to retry
+		{"region unknown", "GET", false, http.StatusInternalServerError, []string{
+			"GET /bucket/file.txt us-east-1",
+			"HEAD /bucket us-east-1",
+			"GET /bucket/file.txt us-east-1",
+			"HEAD /bucket us-east-1",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &regionS3{region: "eu-west-1", header: test.header}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			setup(t, map[string]string{
+				"S3_ENDPOINT":           server.URL,
+				"AWS_REGION":            "us-east-1",
+				"AWS_ACCESS_KEY_ID":     "AKID",
+				"AWS_SECRET_ACCESS_KEY": "SECRET",
+			})
+			svc = realS3(t)
+
+			// The second request goes straight to the bucket's region
+			for i := 0; i < 2; i++ {
+				w := serve(newRequest(test.method, "/file.txt"))
+				if w.Code != test.status {
+					t.Errorf("request %d: status = %d, want %d", i, w.Code, test.status)
+				}
+				if test.status == http.StatusOK && test.method == "GET" && w.Body.String() != "hello" {
+					t.Errorf("request %d: body = %q", i, w.Body.String())
+				}
+			}
+			if got := strings.Join(fake.requests, "\n"); got != strings.Join(test.requests, "\n") {
+				t.Errorf("S3 got:\n%s\nwant:\n%s", got, strings.Join(test.requests, "\n"))
+			}
+		})
+	}
+}
+
+func TestRelocateConcurrent(t *testing.T) {
+	fake := &regionS3{region: "eu-west-1", header: true, hold: make(chan struct{})}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	setup(t, map[string]string{
+		"S3_ENDPOINT":           server.URL,
+		"AWS_REGION":            "us-east-1",
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+	})
+	svc = realS3(t)
+
+	wrong := awserr.New("BucketRegionError", "incorrect region", nil)
+	results := make(chan bool, 5)
+	for i := 0; i < cap(results); i++ {
+		go func() { results <- relocate(context.Background(), "bucket", wrong) }()
+	}
+	// Let every request find the lookup in progress
+	time.Sleep(50 * time.Millisecond)
+	close(fake.hold)
+	for i := 0; i < cap(results); i++ {
+		if !<-results {
+			t.Error("relocate = false, want true")
+		}
+	}
+
+	// One lookup, so one client for the region
+	if n := fake.count("HEAD /bucket "); n != 1 {
+		t.Errorf("%d bucket lookups, want 1", n)
+	}
+	if s3For("bucket") == svc {
+		t.Error("bucket still uses the default client")
+	}
+}
+
+func TestWithResponseHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		response *http.Response
+		want     string
+	}{
+		// Requests failing before they are sent have no response
+		{"no response", nil, "unchanged"},
+		{"without header", &http.Response{Header: http.Header{}}, ""},
+		{"with header", &http.Response{Header: http.Header{"X-Amz-Bucket-Region": {"eu-west-1"}}}, "eu-west-1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value := "unchanged"
+			req := &request.Request{HTTPResponse: test.response}
+			req.ApplyOptions(withResponseHeader("X-Amz-Bucket-Region", &value))
+			req.Handlers.Complete.Run(req)
+			if value != test.want {
+				t.Errorf("value = %q, want %q", value, test.want)
+			}
+		})
+	}
+}